@@ -0,0 +1,44 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// src_color is the color of a source pixel with the alpha divided out, so a
+// half transparent red still matches red tiles, and the alpha itself.
+func src_color(img image.Image, x int, y int) (color.RGBA, uint8) {
+	r, g, b, a := img.At(x, y).RGBA()
+	if a == 0 {
+		return color.RGBA{}, 0
+	}
+	if a < 0xffff {
+		r = r * 0xffff / a
+		g = g * 0xffff / a
+		b = b * 0xffff / a
+	}
+	return color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 0}, uint8(a >> 8)
+}
+
+// fade_cell makes what was drawn in rect as transparent as the source cell.
+func fade_cell(dst *image.RGBA, rect image.Rectangle, a uint8) {
+	rect = rect.Intersect(dst.Bounds())
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		pix := dst.Pix[dst.PixOffset(rect.Min.X, y):dst.PixOffset(rect.Max.X, y)]
+		for i := range pix {
+			pix[i] = uint8(int(pix[i]) * int(a) / 255)
+		}
+	}
+}
+
+// flatten_white puts dst on a white background in place, for formats without
+// alpha.
+func flatten_white(dst *image.RGBA) {
+	for i := 0; i < len(dst.Pix); i += 4 {
+		back := 255 - int(dst.Pix[i+3])
+		dst.Pix[i] = uint8(int(dst.Pix[i]) + back)
+		dst.Pix[i+1] = uint8(int(dst.Pix[i+1]) + back)
+		dst.Pix[i+2] = uint8(int(dst.Pix[i+2]) + back)
+		dst.Pix[i+3] = 255
+	}
+}
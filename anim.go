@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Frames is an animated source: the frames of a gif, or the images of a
+// directory in name order, each the full picture.
+type Frames struct {
+	images []image.Image
+	// in 1/100s
+	delays []int
+	loop   int
+}
+
+// load_frames returns nil when src is a single picture.
+func load_frames(src string, framedelay int) (*Frames, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		loggo.Error("load_frames Stat fail %s %s", src, err)
+		return nil, err
+	}
+	if fi.IsDir() {
+		return load_frame_dir(src, framedelay)
+	}
+	if strings.ToLower(filepath.Ext(src)) != ".gif" {
+		return nil, nil
+	}
+
+	reader, err := os.Open(src)
+	if err != nil {
+		loggo.Error("load_frames Open fail %s %s", src, err)
+		return nil, err
+	}
+	defer reader.Close()
+	g, err := gif.DecodeAll(reader)
+	if err != nil {
+		loggo.Error("load_frames Decode gif fail %s %s", src, err)
+		return nil, err
+	}
+	if len(g.Image) <= 1 {
+		return nil, nil
+	}
+
+	// a gif frame only holds what changed, composite them as a player would
+	fs := &Frames{loop: g.LoopCount}
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, frame := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var saved *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			saved = image.NewRGBA(canvas.Bounds())
+			copy(saved.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		img := image.NewRGBA(canvas.Bounds())
+		copy(img.Pix, canvas.Pix)
+		fs.images = append(fs.images, img)
+		delay := framedelay
+		if i < len(g.Delay) && g.Delay[i] > 0 {
+			delay = g.Delay[i]
+		}
+		fs.delays = append(fs.delays, delay)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = saved
+		}
+	}
+
+	loggo.Info("load_frames gif ok %s frames %d %d*%d loop %d", src, len(fs.images), g.Config.Width, g.Config.Height, fs.loop)
+	return fs, nil
+}
+
+func load_frame_dir(dir string, framedelay int) (*Frames, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		loggo.Error("load_frame_dir ReadDir fail %s %s", dir, err)
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+
+	fs := &Frames{}
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		if f.IsDir() {
+			continue
+		}
+		if _, err := sniff_image(path); err != nil {
+			loggo.Info("load_frame_dir skip %s", path)
+			continue
+		}
+		err, img := load_src(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(fs.images) > 0 && img.Bounds().Size() != fs.images[0].Bounds().Size() {
+			loggo.Error("load_frame_dir frame size fail %s %v, the first is %v", path, img.Bounds().Size(), fs.images[0].Bounds().Size())
+			return nil, errors.New("frame size error")
+		}
+		fs.images = append(fs.images, img)
+		fs.delays = append(fs.delays, framedelay)
+	}
+	if len(fs.images) == 0 {
+		loggo.Error("load_frame_dir no image in %s", dir)
+		return nil, errors.New("no frame")
+	}
+
+	loggo.Info("load_frame_dir ok %s frames %d", dir, len(fs.images))
+	return fs, nil
+}
+
+// Anim renders the frames one by one. A cell keeps the tile of the frame
+// before while its color stays within threshold of the color the tile was
+// picked for, so the tiles do not flicker with noise and slow changes.
+type Anim struct {
+	threshold float64
+	frames    *Frames
+	// the frame drawn last, nil before the first
+	prev   *image.RGBA
+	keys   []string
+	colors []color.RGBA
+	alphas []uint8
+	kept   int32
+	out    *FrameWriter
+	// the jobs of the frames done, dropped once all are written
+	jobs []string
+}
+
+// FrameWriter writes the frames of an animation into a gif, or for any other
+// target into files of their own named target_0000.ext on.
+type FrameWriter struct {
+	target string
+	gif    *gif.GIF
+	num    int
+	// the frame files are written as the target would be
+	dpi          int
+	tiffcompress bool
+	bigtiff      bool
+	workernum    int
+}
+
+func new_frame_writer(target string, loop int, dpi int, tiffcompress bool, bigtiff bool, workernum int) *FrameWriter {
+	fw := &FrameWriter{target: target, dpi: dpi, tiffcompress: tiffcompress, bigtiff: bigtiff, workernum: workernum}
+	if strings.ToLower(filepath.Ext(target)) == ".gif" {
+		fw.gif = &gif.GIF{LoopCount: loop}
+	}
+	return fw
+}
+
+func new_anim(target string, frames *Frames, threshold float64, dpi int, tiffcompress bool, bigtiff bool, workernum int) *Anim {
+	return &Anim{threshold: threshold, frames: frames,
+		out: new_frame_writer(target, frames.loop, dpi, tiffcompress, bigtiff, workernum)}
+}
+
+// keep reports if the cell may show the tile of the frame before.
+func (anim *Anim) keep(cell int, c color.RGBA, a uint8) bool {
+	if anim == nil || anim.prev == nil || anim.threshold <= 0 || anim.keys[cell] == "" {
+		return false
+	}
+	if anim.alphas[cell] != a || common.ColorDistance(anim.colors[cell], c) > anim.threshold {
+		return false
+	}
+	atomic.AddInt32(&anim.kept, 1)
+	return true
+}
+
+// set records the tile drawn into a cell for the color c.
+func (anim *Anim) set(cell int, key string, c color.RGBA, a uint8) {
+	if anim == nil {
+		return
+	}
+	anim.keys[cell] = key
+	anim.colors[cell] = c
+	anim.alphas[cell] = a
+}
+
+// begin makes ready for a frame of cells cells.
+func (anim *Anim) begin(cells int) {
+	if len(anim.keys) != cells {
+		anim.prev = nil
+		anim.keys = make([]string, cells)
+		anim.colors = make([]color.RGBA, cells)
+		anim.alphas = make([]uint8, cells)
+	}
+}
+
+// add_frame keeps the frame drawn for the next and writes it out, written
+// when a run before already did.
+func (anim *Anim) add_frame(canvas *image.RGBA, written bool) error {
+	loggo.Info("add_frame %d/%d kept cells %d/%d", anim.out.num+1, len(anim.frames.images), anim.kept, len(anim.keys))
+	anim.prev = canvas
+	anim.kept = 0
+	return anim.out.add(canvas, anim.frames.delays[anim.out.num], written)
+}
+
+func (anim *Anim) write() error {
+	return anim.out.write()
+}
+
+// add writes a frame shown for delay 1/100s, as the frame of the gif or a file
+// of its own. A frame file written by a run before is left as it is.
+func (fw *FrameWriter) add(canvas *image.RGBA, delay int, written bool) error {
+	fw.num++
+
+	if fw.gif == nil {
+		ext := filepath.Ext(fw.target)
+		name := fmt.Sprintf("%s_%04d%s", strings.TrimSuffix(fw.target, ext), fw.num-1, ext)
+		if _, err := os.Stat(name); written && err == nil {
+			loggo.Info("frame writer skip written %s", name)
+			return nil
+		}
+		// written from a copy, jpeg flattens it in place
+		out := image.NewRGBA(canvas.Bounds())
+		copy(out.Pix, canvas.Pix)
+		return write_target(out, name, fw.dpi, fw.tiffcompress, fw.bigtiff, fw.workernum)
+	}
+
+	// the same fixed palette every frame, an adaptive one would flicker
+	pal := color.Palette(palette.Plan9)
+	disposal := byte(gif.DisposalNone)
+	if !canvas.Opaque() {
+		pal = append(color.Palette{image.Transparent}, palette.WebSafe...)
+		disposal = gif.DisposalBackground
+	}
+	img := image.NewPaletted(canvas.Bounds(), pal)
+	draw.Draw(img, img.Bounds(), canvas, canvas.Bounds().Min, draw.Src)
+	fw.gif.Image = append(fw.gif.Image, img)
+	fw.gif.Delay = append(fw.gif.Delay, delay)
+	fw.gif.Disposal = append(fw.gif.Disposal, disposal)
+	return nil
+}
+
+func (fw *FrameWriter) write() error {
+	if fw.gif == nil {
+		loggo.Info("frame writer ok %s %d frames", fw.target, fw.num)
+		return nil
+	}
+	file, err := os.Create(fw.target)
+	if err != nil {
+		loggo.Error("frame writer Create fail %s %s", fw.target, err)
+		return err
+	}
+	err = gif.EncodeAll(file, fw.gif)
+	if err != nil {
+		file.Close()
+		os.Remove(fw.target)
+		loggo.Error("frame writer EncodeAll fail %s %s", fw.target, err)
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		os.Remove(fw.target)
+		loggo.Error("frame writer Close fail %s %s", fw.target, err)
+		return err
+	}
+	loggo.Info("frame writer ok %s %d frames", fw.target, fw.num)
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// BuildUp renders a clip of the finished mosaic assembling: the cells appear
+// in scan, random or color order, and the view zooms from a single tile out to
+// the full picture or back in.
+type BuildUp struct {
+	target string
+	order  string
+	zoom   string
+	// the cell zoomed on, -1 for the center
+	focusx int
+	focusy int
+	frames int
+	width  int
+	// in 1/100s
+	delay int
+}
+
+func new_build_up(target string, order string, zoom string, focus string, frames int, width int, delay int) (*BuildUp, error) {
+	if target == "" {
+		return nil, nil
+	}
+	if order != "scan" && order != "random" && order != "color" && order != "none" {
+		loggo.Error("new_build_up unknown order %s, use scan/random/color/none", order)
+		return nil, errors.New("unknown build order")
+	}
+	if zoom != "none" && zoom != "out" && zoom != "in" {
+		loggo.Error("new_build_up unknown zoom %s, use none/out/in", zoom)
+		return nil, errors.New("unknown build zoom")
+	}
+	if order == "none" && zoom == "none" {
+		loggo.Error("new_build_up order and zoom both none, nothing moves")
+		return nil, errors.New("build up error")
+	}
+	if frames < 2 || width <= 0 || delay <= 0 {
+		loggo.Error("new_build_up frames %d width %d delay %d fail", frames, width, delay)
+		return nil, errors.New("build up error")
+	}
+	bu := &BuildUp{target: target, order: order, zoom: zoom, focusx: -1, focusy: -1, frames: frames, width: width, delay: delay}
+	if focus != "" {
+		n, err := fmt.Sscanf(focus, "%d,%d", &bu.focusx, &bu.focusy)
+		if n != 2 || err != nil || bu.focusx < 0 || bu.focusy < 0 {
+			loggo.Error("new_build_up focus fail %s, use x,y of a cell", focus)
+			return nil, errors.New("build focus error")
+		}
+	}
+	return bu, nil
+}
+
+// hue of a color in degrees, grays first.
+func hue(c color.RGBA) float64 {
+	r := float64(c.R)
+	g := float64(c.G)
+	b := float64(c.B)
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	if max == min {
+		return -1
+	}
+	var h float64
+	switch max {
+	case r:
+		h = math.Mod((g-b)/(max-min), 6)
+	case g:
+		h = (b-r)/(max-min) + 2
+	default:
+		h = (r-g)/(max-min) + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+func (bu *BuildUp) focus(gridx int, gridy int) (int, int) {
+	fx := bu.focusx
+	fy := bu.focusy
+	if fx < 0 || fx >= gridx {
+		fx = gridx / 2
+	}
+	if fy < 0 || fy >= gridy {
+		fy = gridy / 2
+	}
+	return fx, fy
+}
+
+// cell_order is the cells in the order they appear, with a zoom the tile
+// zoomed on first.
+func (bu *BuildUp) cell_order(srcimg image.Image, gridx int, gridy int) []int {
+	order := make([]int, gridx*gridy)
+	for i := range order {
+		order[i] = i
+	}
+	switch bu.order {
+	case "random":
+		for i := len(order) - 1; i > 0; i-- {
+			j := int(common.RandInt31n(i + 1))
+			order[i], order[j] = order[j], order[i]
+		}
+	case "color":
+		min := srcimg.Bounds().Min
+		hues := make([]float64, len(order))
+		lumas := make([]float64, len(order))
+		for i := range order {
+			c, _ := src_color(srcimg, min.X+i%gridx, min.Y+i/gridx)
+			hues[i] = hue(c)
+			lumas[i] = luma(c)
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			if hues[order[i]] != hues[order[j]] {
+				return hues[order[i]] < hues[order[j]]
+			}
+			return lumas[order[i]] < lumas[order[j]]
+		})
+	}
+	if bu.zoom != "none" {
+		fx, fy := bu.focus(gridx, gridy)
+		for i, cell := range order {
+			if cell == fy*gridx+fx {
+				copy(order[1:i+1], order[:i])
+				order[0] = cell
+				break
+			}
+		}
+	}
+	return order
+}
+
+// view is the part of the mosaic rect shown at t from 0 to 1 of the zoom out,
+// one cell around the focus at 0 and all of it at 1.
+func (bu *BuildUp) view(rect image.Rectangle, cellsize int, gridx int, gridy int, t float64) image.Rectangle {
+	if bu.zoom == "none" {
+		return rect
+	}
+	if bu.zoom == "in" {
+		t = 1 - t
+	}
+	fx, fy := bu.focus(gridx, gridy)
+	cx := float64(rect.Min.X) + (float64(fx)+0.5)*float64(cellsize)
+	cy := float64(rect.Min.Y) + (float64(fy)+0.5)*float64(cellsize)
+
+	// the shorter side one cell, growing by the same factor every frame
+	w := float64(rect.Dx())
+	h := float64(rect.Dy())
+	start := float64(cellsize) / math.Min(w, h)
+	s := math.Pow(start, 1-t)
+	w *= s
+	h *= s
+
+	x0 := math.Max(float64(rect.Min.X), math.Min(cx-w/2, float64(rect.Max.X)-w))
+	y0 := math.Max(float64(rect.Min.Y), math.Min(cy-h/2, float64(rect.Max.Y)-h))
+	view := image.Rect(int(math.Round(x0)), int(math.Round(y0)), int(math.Round(x0+w)), int(math.Round(y0+h)))
+	if view.Dx() < 1 || view.Dy() < 1 {
+		view.Max = view.Min.Add(image.Point{1, 1})
+	}
+	return view.Intersect(rect)
+}
+
+// render writes the clip from the drawn mosaic, rect is where its cells are in
+// canvas.
+func (bu *BuildUp) render(canvas *image.RGBA, rect image.Rectangle, srcimg image.Image, gridx int, gridy int, cellsize int,
+	dpi int, tiffcompress bool, bigtiff bool, workernum int) error {
+	loggo.Info("build_up %s order %s zoom %s frames %d width %d", bu.target, bu.order, bu.zoom, bu.frames, bu.width)
+
+	order := bu.cell_order(srcimg, gridx, gridy)
+	height := common.MaxOfInt(1, bu.width*rect.Dy()/rect.Dx())
+	fw := new_frame_writer(bu.target, 0, dpi, tiffcompress, bigtiff, workernum)
+
+	// the cells shown so far on white
+	shown := image.NewRGBA(rect)
+	draw.Draw(shown, rect, &image.Uniform{color.White}, image.Point{}, draw.Src)
+	if bu.order == "none" {
+		draw.Draw(shown, rect, canvas, rect.Min, draw.Over)
+	}
+
+	num := 0
+	for i := 0; i < bu.frames; i++ {
+		t := float64(i) / float64(bu.frames-1)
+		if bu.order != "none" {
+			for end := len(order) * (i + 1) / bu.frames; num < end; num++ {
+				x := order[num] % gridx
+				y := order[num] / gridx
+				cell := image.Rect(rect.Min.X+x*cellsize, rect.Min.Y+y*cellsize, rect.Min.X+(x+1)*cellsize, rect.Min.Y+(y+1)*cellsize)
+				draw.Draw(shown, cell, canvas, cell.Min, draw.Over)
+			}
+		}
+
+		view := bu.view(rect, cellsize, gridx, gridy, t)
+		frame := image.NewRGBA(image.Rect(0, 0, bu.width, height))
+		draw.ApproxBiLinear.Scale(frame, frame.Bounds(), shown, view, draw.Src, nil)
+
+		// the finished picture stays a second
+		delay := bu.delay
+		if i == bu.frames-1 {
+			delay = common.MaxOfInt(delay, 100)
+		}
+		err := fw.add(frame, delay, false)
+		if err != nil {
+			return err
+		}
+	}
+	return fw.write()
+}
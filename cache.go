@@ -0,0 +1,104 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"image"
+	"sync"
+)
+
+// TileCache keeps the decoded tiles most recently drawn, keyed by the content
+// hash, and evicts the least recently used ones once the decoded pixels take
+// more than limit bytes. It is shared by all workers of a render.
+type TileCache struct {
+	limit   int64
+	size    int64
+	lru     *list.List
+	items   map[string]*list.Element
+	lock    sync.Mutex
+	hits    int64
+	misses  int64
+	evicted int64
+}
+
+type TileCacheItem struct {
+	key  string
+	img  image.Image
+	size int64
+}
+
+func new_tile_cache(limit int64) *TileCache {
+	return &TileCache{limit: limit, lru: list.New(), items: make(map[string]*list.Element)}
+}
+
+// image_mem_size is about the memory held by the pixels of a decoded image.
+func image_mem_size(img image.Image) int64 {
+	switch i := img.(type) {
+	case *image.RGBA:
+		return int64(len(i.Pix))
+	case *image.NRGBA:
+		return int64(len(i.Pix))
+	case *image.Gray:
+		return int64(len(i.Pix))
+	case *image.YCbCr:
+		return int64(len(i.Y) + len(i.Cb) + len(i.Cr))
+	case *image.Uniform:
+		return 0
+	}
+	return int64(img.Bounds().Dx() * img.Bounds().Dy() * 4)
+}
+
+// load returns the cached tile of key, else loads it with loader and caches it.
+// Two workers missing the same key at once both load it, the tile is small and
+// that is cheaper than holding the lock while decoding.
+func (tc *TileCache) load(key string, loader func() (image.Image, error)) (image.Image, error) {
+	tc.lock.Lock()
+	if e, ok := tc.items[key]; ok {
+		tc.lru.MoveToFront(e)
+		tc.hits++
+		img := e.Value.(*TileCacheItem).img
+		tc.lock.Unlock()
+		return img, nil
+	}
+	tc.misses++
+	tc.lock.Unlock()
+
+	img, err := loader()
+	if err != nil {
+		return nil, err
+	}
+
+	size := image_mem_size(img)
+	if size > tc.limit {
+		return img, nil
+	}
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if e, ok := tc.items[key]; ok {
+		tc.lru.MoveToFront(e)
+		return e.Value.(*TileCacheItem).img, nil
+	}
+	tc.items[key] = tc.lru.PushFront(&TileCacheItem{key: key, img: img, size: size})
+	tc.size += size
+	for tc.size > tc.limit {
+		e := tc.lru.Back()
+		item := e.Value.(*TileCacheItem)
+		tc.lru.Remove(e)
+		delete(tc.items, item.key)
+		tc.size -= item.size
+		tc.evicted++
+	}
+	return img, nil
+}
+
+func (tc *TileCache) stats() string {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	rate := int64(0)
+	if tc.hits+tc.misses > 0 {
+		rate = tc.hits * 100 / (tc.hits + tc.misses)
+	}
+	return fmt.Sprintf("hits=%d misses=%d hit-rate=%d%% tiles=%d mem=%dMB evicted=%d", tc.hits, tc.misses, rate, len(tc.items),
+		tc.size/1024/1024, tc.evicted)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// color space is split into coverage_level^3 bins for the analysis
+const coverage_level = 8
+const coverage_step = 256 / coverage_level
+
+type CoverageBin struct {
+	c      color.RGBA
+	tiles  int
+	gap    float64
+	demand int
+	err    float64
+}
+
+func coverage_bin(c color.RGBA) int {
+	return int(c.R)/coverage_step*coverage_level*coverage_level + int(c.G)/coverage_step*coverage_level + int(c.B)/coverage_step
+}
+
+func coverage_bin_color(bin int) color.RGBA {
+	r := bin / (coverage_level * coverage_level)
+	g := bin / coverage_level % coverage_level
+	b := bin % coverage_level
+	half := coverage_step / 2
+	return color.RGBA{uint8(r*coverage_step + half), uint8(g*coverage_step + half), uint8(b*coverage_step + half), 255}
+}
+
+func min_distance(c color.RGBA, tiles []color.RGBA) float64 {
+	min := math.MaxFloat64
+	for _, t := range tiles {
+		diff := common.ColorDistance(c, t)
+		if diff < min {
+			min = diff
+		}
+	}
+	return min
+}
+
+// coverage_lib maps how the tiles of the lib cover color space and, with a
+// source, how well every cell of it can be matched, then recommends the colors
+// the lib needs more of. The report goes to the log and to output with a .txt
+// suffix, the chart to output.
+func coverage_lib(database string, libname string, pixelsize int, srcimg image.Image, output string, top int) error {
+	loggo.Info("coverage_lib %s %s pixelsize %d", database, libname, pixelsize)
+
+	db, err := open_database(database)
+	if err != nil {
+		loggo.Error("coverage_lib Open database fail %s %s", database, err)
+		return err
+	}
+
+	var tiles []color.RGBA
+	tile_bucket_name := make_tile_bucket(libname, pixelsize)
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(tile_bucket_name))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			ti, err := decode_tile_info(v)
+			if err != nil {
+				loggo.Error("coverage_lib Decode fail %s %s", string(k), err)
+				return nil
+			}
+			tiles = append(tiles, color.RGBA{ti.R, ti.G, ti.B, 0})
+			return nil
+		})
+	})
+	db.Close()
+
+	if len(tiles) <= 0 {
+		loggo.Error("coverage_lib no pic in database %s %s, load the lib with this pixelsize first", database, tile_bucket_name)
+		return errors.New("no pic")
+	}
+
+	bins := make([]CoverageBin, coverage_level*coverage_level*coverage_level)
+	for i := range bins {
+		bins[i].c = coverage_bin_color(i)
+		c := bins[i].c
+		c.A = 0
+		bins[i].gap = min_distance(c, tiles)
+	}
+	for _, t := range tiles {
+		bins[coverage_bin(t)].tiles++
+	}
+
+	var report []string
+	report = append(report, fmt.Sprintf("lib %s pixelsize %d tiles %d", libname, pixelsize, len(tiles)))
+
+	empty := 0
+	maxtiles := 0
+	for _, b := range bins {
+		if b.tiles == 0 {
+			empty++
+		}
+		if b.tiles > maxtiles {
+			maxtiles = b.tiles
+		}
+	}
+	report = append(report, fmt.Sprintf("color bins %d empty %d max tiles per bin %d", len(bins), empty, maxtiles))
+
+	if srcimg != nil {
+		bounds := srcimg.Bounds()
+		var errs []float64
+		memo := make(map[color.RGBA]float64)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c, a := src_color(srcimg, x, y)
+				if a == 0 {
+					continue
+				}
+				diff, ok := memo[c]
+				if !ok {
+					diff = min_distance(c, tiles)
+					memo[c] = diff
+				}
+				bin := &bins[coverage_bin(c)]
+				bin.demand++
+				bin.err += diff
+				errs = append(errs, diff)
+			}
+		}
+
+		sort.Float64s(errs)
+		sum := 0.0
+		for _, e := range errs {
+			sum += e
+		}
+		if len(errs) == 0 {
+			report = append(report, "src no cells")
+		} else {
+			report = append(report, fmt.Sprintf("src cells %d mean error %.2f median %.2f p90 %.2f max %.2f", len(errs),
+				sum/float64(len(errs)), errs[len(errs)/2], errs[len(errs)*9/10], errs[len(errs)-1]))
+		}
+	}
+
+	// with a source the bins costing the most error in total, else the biggest holes
+	var order []int
+	for i, b := range bins {
+		if srcimg == nil || b.demand > 0 {
+			order = append(order, i)
+		}
+	}
+	score := func(i int) float64 {
+		if srcimg != nil {
+			return bins[i].err
+		}
+		return bins[i].gap
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return score(order[i]) > score(order[j])
+	})
+	if top >= 0 && len(order) > top {
+		order = order[:top]
+	}
+
+	report = append(report, "need more of:")
+	for n, i := range order {
+		b := bins[i]
+		line := fmt.Sprintf("%2d #%02x%02x%02x tiles %d gap %.2f", n+1, b.c.R, b.c.G, b.c.B, b.tiles, b.gap)
+		if srcimg != nil {
+			line += fmt.Sprintf(" src cells %d mean error %.2f", b.demand, b.err/float64(b.demand))
+		}
+		report = append(report, line)
+	}
+
+	for _, line := range report {
+		loggo.Info("coverage_lib %s", line)
+	}
+
+	txt := strings.TrimSuffix(output, filepath.Ext(output)) + ".txt"
+	err = ioutil.WriteFile(txt, []byte(strings.Join(report, "\n")+"\n"), 0644)
+	if err != nil {
+		loggo.Error("coverage_lib write report fail %s %s", txt, err)
+		return err
+	}
+
+	chart := draw_coverage_chart(bins, order, score, maxtiles, srcimg != nil)
+	file, err := os.Create(output)
+	if err != nil {
+		loggo.Error("coverage_lib Create fail %s %s", output, err)
+		return err
+	}
+	defer file.Close()
+	err = png.Encode(file, chart)
+	if err != nil {
+		loggo.Error("coverage_lib png Encode fail %s %s", output, err)
+		return err
+	}
+
+	loggo.Info("coverage_lib ok %s %s", output, txt)
+	return nil
+}
+
+// draw_coverage_chart draws the recommended colors as swatches with a bar for
+// their score, then color space as coverage_level panels of red, each with
+// green rows and blue columns. The bar under a bin grows with its tile count
+// and is red across when the bin is empty. With a source a second row of
+// panels shows the match error of each bin.
+func draw_coverage_chart(bins []CoverageBin, order []int, score func(int) float64, maxtiles int, withsrc bool) *image.RGBA {
+	const margin = 16
+	const swatch = 48
+	const cell = 24
+	const bar = 6
+	const panelgap = 12
+
+	panel := coverage_level * cell
+	width := 2*margin + coverage_level*panel + (coverage_level-1)*panelgap
+	rows := 1
+	if withsrc {
+		rows = 2
+	}
+	// the recommended colors wrap onto as many rows as they need
+	perrow := (width - 2*margin + swatch/4) / (swatch + swatch/4)
+	swatchrows := (len(order) + perrow - 1) / perrow
+	if swatchrows < 1 {
+		swatchrows = 1
+	}
+	swatchrow := swatch + bar + margin/2
+	swatches := swatchrows*swatchrow - margin/2
+	height := 2*margin + swatches + margin + rows*panel + (rows-1)*margin
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	fill := func(r image.Rectangle, c color.RGBA) {
+		draw.Draw(img, r, &image.Uniform{c}, image.Point{}, draw.Src)
+	}
+	white := color.RGBA{255, 255, 255, 255}
+	black := color.RGBA{0, 0, 0, 255}
+	red := color.RGBA{255, 0, 0, 255}
+	fill(img.Bounds(), white)
+
+	maxscore := 0.0
+	for _, i := range order {
+		if score(i) > maxscore {
+			maxscore = score(i)
+		}
+	}
+	for n, i := range order {
+		x := margin + n%perrow*(swatch+swatch/4)
+		y := margin + n/perrow*swatchrow
+		fill(image.Rect(x, y, x+swatch, y+swatch), bins[i].c)
+		w := swatch
+		if maxscore > 0 {
+			w = int(float64(swatch) * score(i) / maxscore)
+		}
+		fill(image.Rect(x, y+swatch, x+w, y+swatch+bar), black)
+	}
+
+	maxerr := 0.0
+	for _, b := range bins {
+		if b.err > maxerr {
+			maxerr = b.err
+		}
+	}
+
+	for row := 0; row < rows; row++ {
+		top := 2*margin + swatches + row*(panel+margin)
+		for i, b := range bins {
+			r := i / (coverage_level * coverage_level)
+			g := i / coverage_level % coverage_level
+			bl := i % coverage_level
+			x := margin + r*(panel+panelgap) + bl*cell
+			y := top + g*cell
+			fill(image.Rect(x, y, x+cell, y+cell-bar), b.c)
+
+			strip := image.Rect(x, y+cell-bar, x+cell, y+cell)
+			if row == 0 {
+				if b.tiles == 0 {
+					fill(strip, red)
+				} else {
+					w := int(float64(cell) * math.Log(float64(b.tiles+1)) / math.Log(float64(maxtiles+1)))
+					fill(image.Rect(x, y+cell-bar, x+w, y+cell), black)
+				}
+			} else if b.demand > 0 && maxerr > 0 {
+				w := int(math.Ceil(float64(cell) * b.err / maxerr))
+				fill(image.Rect(x, y+cell-bar, x+w, y+cell), red)
+			}
+		}
+	}
+
+	return img
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/esrrhs/gohome/loggo"
+	"image"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// db_version is the schema this binary reads and writes. Bump it together with
+// a new entry in migrations whenever the layout or the encoded structs change.
+const db_version = 4
+
+const meta_bucket_name = "Meta"
+const meta_version_key = "version"
+
+// root_bucket_name holds the root path of each lib, files in the lib are keyed relative to it.
+const root_bucket_name = "Root"
+
+// Migration upgrades with batch in several transactions when it reads every lib
+// file, then with run in the one that records the version. batch must be safe
+// to run again after a failure.
+type Migration struct {
+	version int
+	name    string
+	run     func(tx *bolt.Tx) error
+	batch   func(db *bolt.DB) error
+}
+
+// migrations upgrade a database from the version before to version, in order.
+// Versions 1 to 3 were never released, a database is either without a version
+// record or at 4.
+var migrations = []Migration{
+	{4, "move the FileInfo buckets per lib and pixel size to Lib, Path and Tile buckets by content hash", migrate_v4_drop, migrate_v4},
+}
+
+// migrate_batch is the number of entries a batch migration handles per transaction.
+const migrate_batch = 1000
+
+// Lib:<libname> holds FileInfo by content hash, Path:<libname> maps every
+// file to its hash, Tile:<libname>:<pixelsize> and Thumb:<libname>:<pixelsize>
+// hold the data derived for one pixel size, Preview:<libname> the tiny thumb
+// for previews, all by hash.
+func make_lib_bucket(libname string) string {
+	return "Lib:" + libname
+}
+
+func make_path_bucket(libname string) string {
+	return "Path:" + libname
+}
+
+func make_preview_bucket(libname string) string {
+	return "Preview:" + libname
+}
+
+func make_tile_bucket(libname string, pixelsize int) string {
+	return "Tile:" + libname + ":" + strconv.Itoa(pixelsize)
+}
+
+func make_thumb_bucket(libname string, pixelsize int) string {
+	return "Thumb:" + libname + ":" + strconv.Itoa(pixelsize)
+}
+
+// lib_sub_buckets returns the names of all buckets of the lib derived from the content.
+func lib_sub_buckets(tx *bolt.Tx, libname string) []string {
+	var names []string
+	tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if strings.HasPrefix(string(name), "Tile:"+libname+":") || strings.HasPrefix(string(name), "Thumb:"+libname+":") ||
+			string(name) == make_preview_bucket(libname) {
+			names = append(names, string(name))
+		}
+		return nil
+	})
+	return names
+}
+
+// remove_lib_path drops one file from the lib, the content goes with its last file.
+func remove_lib_path(tx *bolt.Tx, libname string, path string) error {
+	pb := tx.Bucket([]byte(make_path_bucket(libname)))
+	hash := pb.Get([]byte(path))
+	if hash == nil {
+		return nil
+	}
+	hash = append([]byte(nil), hash...)
+	err := pb.Delete([]byte(path))
+	if err != nil {
+		return err
+	}
+
+	b := tx.Bucket([]byte(make_lib_bucket(libname)))
+	v := b.Get(hash)
+	if v != nil {
+		fi, err := decode_file_info(v)
+		if err == nil {
+			paths := fi.Paths[:0]
+			for _, p := range fi.Paths {
+				if p != path {
+					paths = append(paths, p)
+				}
+			}
+			fi.Paths = paths
+			if len(fi.Paths) > 0 {
+				nv, err := encode_file_info(&fi)
+				if err != nil {
+					return err
+				}
+				return b.Put(hash, nv)
+			}
+		}
+	}
+
+	err = b.Delete(hash)
+	if err != nil {
+		return err
+	}
+	for _, sub := range lib_sub_buckets(tx, libname) {
+		err = tx.Bucket([]byte(sub)).Delete(hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func get_lib_root(tx *bolt.Tx, libname string) string {
+	b := tx.Bucket([]byte(root_bucket_name))
+	if b == nil {
+		return ""
+	}
+	return string(b.Get([]byte(libname)))
+}
+
+func set_lib_root(tx *bolt.Tx, libname string, root string) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(root_bucket_name))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(libname), []byte(root))
+}
+
+// path_within returns path relative to dir if path is dir or below it.
+func path_within(dir string, path string) (string, bool) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// rekey_lib_paths puts prefix, a slash separated directory, in front of every
+// file of the lib, when the lib root moves up to a parent directory.
+func rekey_lib_paths(tx *bolt.Tx, libname string, prefix string) error {
+	if prefix == "" || prefix == "." {
+		return nil
+	}
+	pb := tx.Bucket([]byte(make_path_bucket(libname)))
+	b := tx.Bucket([]byte(make_lib_bucket(libname)))
+	if pb == nil || b == nil {
+		return nil
+	}
+
+	type kv struct {
+		k, v []byte
+	}
+	var all []kv
+	pb.ForEach(func(k, v []byte) error {
+		all = append(all, kv{append([]byte(nil), k...), append([]byte(nil), v...)})
+		return nil
+	})
+	for _, e := range all {
+		err := pb.Delete(e.k)
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range all {
+		err := pb.Put([]byte(path.Join(prefix, string(e.k))), e.v)
+		if err != nil {
+			return err
+		}
+	}
+
+	var files []kv
+	b.ForEach(func(k, v []byte) error {
+		files = append(files, kv{append([]byte(nil), k...), append([]byte(nil), v...)})
+		return nil
+	})
+	for _, e := range files {
+		fi, err := decode_file_info(e.v)
+		if err != nil {
+			continue
+		}
+		for i, p := range fi.Paths {
+			fi.Paths[i] = path.Join(prefix, p)
+		}
+		v, err := encode_file_info(&fi)
+		if err != nil {
+			return err
+		}
+		err = b.Put(e.k, v)
+		if err != nil {
+			return err
+		}
+	}
+	loggo.Info("rekey_lib_paths %s %s files %d", libname, prefix, len(all))
+	return nil
+}
+
+// resolve_path turns a slash separated path relative to the lib root into a file path.
+func resolve_path(root string, filename string) string {
+	path := filepath.FromSlash(filename)
+	if filepath.IsAbs(path) || root == "" {
+		return path
+	}
+	return filepath.Join(root, path)
+}
+
+func reroot_lib(database string, libname string, root string) error {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		loggo.Error("reroot_lib get Abs fail %s %s", root, err)
+		return err
+	}
+
+	db, err := open_database(database)
+	if err != nil {
+		loggo.Error("reroot_lib Open database fail %s %s", database, err)
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(make_lib_bucket(libname))) == nil {
+			loggo.Error("reroot_lib no lib %s in %s", libname, database)
+			return errors.New("no lib")
+		}
+		loggo.Info("reroot_lib %s %s -> %s", libname, get_lib_root(tx, libname), abs)
+		return set_lib_root(tx, libname, abs)
+	})
+}
+
+func open_database(database string) (*bolt.DB, error) {
+	db, err := bolt.Open(database, 0600, nil)
+	if err != nil {
+		loggo.Error("open_database Open fail %s %s", database, err)
+		return nil, err
+	}
+
+	version := 0
+	fresh := false
+	err = db.Update(func(tx *bolt.Tx) error {
+		fresh = true
+		tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			fresh = false
+			return nil
+		})
+
+		b, err := tx.CreateBucketIfNotExists([]byte(meta_bucket_name))
+		if err != nil {
+			return err
+		}
+		v := b.Get([]byte(meta_version_key))
+		if v != nil {
+			version, err = strconv.Atoi(string(v))
+			if err != nil {
+				return fmt.Errorf("bad version record %q", string(v))
+			}
+		} else if fresh {
+			version = db_version
+			return b.Put([]byte(meta_version_key), []byte(strconv.Itoa(version)))
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		loggo.Error("open_database read version fail %s %s", database, err)
+		return nil, err
+	}
+
+	if version > db_version {
+		db.Close()
+		loggo.Error("open_database %s is version %d, newer than %d supported by this go-mosaic, please upgrade go-mosaic", database, version, db_version)
+		return nil, errors.New("database version too new")
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		loggo.Info("open_database migrate %s from version %d to %d: %s", database, version, m.version, m.name)
+		if m.batch != nil {
+			err = m.batch(db)
+		}
+		if err == nil {
+			err = db.Update(func(tx *bolt.Tx) error {
+				if m.run != nil {
+					err := m.run(tx)
+					if err != nil {
+						return err
+					}
+				}
+				return tx.Bucket([]byte(meta_bucket_name)).Put([]byte(meta_version_key), []byte(strconv.Itoa(m.version)))
+			})
+		}
+		if err != nil {
+			db.Close()
+			loggo.Error("open_database migrate %s to version %d fail %s", database, m.version, err)
+			return nil, err
+		}
+		version = m.version
+		loggo.Info("open_database migrate %s to version %d ok", database, version)
+	}
+
+	return db, nil
+}
+
+func encode_file_info(fi *FileInfo) ([]byte, error) {
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	err := enc.Encode(fi)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decode_file_info(v []byte) (FileInfo, error) {
+	var fi FileInfo
+	dec := gob.NewDecoder(bytes.NewReader(v))
+	err := dec.Decode(&fi)
+	return fi, err
+}
+
+func encode_tile_info(ti *TileInfo) ([]byte, error) {
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	err := enc.Encode(ti)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func decode_tile_info(v []byte) (TileInfo, error) {
+	var ti TileInfo
+	dec := gob.NewDecoder(bytes.NewReader(v))
+	err := dec.Decode(&ti)
+	return ti, err
+}
+
+// FileInfoV0 is FileInfo as stored before the version record, one
+// FileInfo<libname><pixelsize> bucket per lib and pixel size keyed by the
+// absolute file name.
+type FileInfoV0 struct {
+	Filename string
+	R        uint8
+	G        uint8
+	B        uint8
+	Hash     string
+}
+
+func decode_file_info_v0(v []byte) (FileInfoV0, error) {
+	var fi FileInfoV0
+	dec := gob.NewDecoder(bytes.NewReader(v))
+	err := dec.Decode(&fi)
+	return fi, err
+}
+
+func encode_file_info_v0(fi *FileInfoV0) ([]byte, error) {
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	err := enc.Encode(fi)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// v0_name_readings returns every lib name and pixel size the rest of an old
+// bucket name can be split into, the pixel size being trailing digits.
+func v0_name_readings(rest string) ([]string, []int) {
+	var libnames []string
+	var pixelsizes []int
+	for i := len(rest) - 1; i > 0 && rest[i] >= '0' && rest[i] <= '9'; i-- {
+		if rest[i] == '0' {
+			continue
+		}
+		pixelsize, err := strconv.Atoi(rest[i:])
+		if err != nil || pixelsize <= 0 {
+			continue
+		}
+		libnames = append(libnames, rest[:i])
+		pixelsizes = append(pixelsizes, pixelsize)
+	}
+	return libnames, pixelsizes
+}
+
+// the pixel sizes a tile of an old database may have, to tell "default32" is
+// not lib "default3" at pixel size 2
+const v0_min_pixelsize = 8
+const v0_max_pixelsize = 1024
+
+// v0_bucket_lib reads the lib name and pixel size of an old bucket. When the lib
+// name may end with digits too the only reading with a plausible pixel size is
+// taken, else the bucket is left as it is.
+func v0_bucket_lib(name string) (string, int, bool) {
+	libnames, pixelsizes := v0_name_readings(strings.TrimPrefix(name, "FileInfo"))
+	if len(libnames) == 1 {
+		return libnames[0], pixelsizes[0], true
+	}
+	plausible := -1
+	for i := range libnames {
+		if pixelsizes[i] >= v0_min_pixelsize && pixelsizes[i] <= v0_max_pixelsize {
+			if plausible >= 0 {
+				return "", 0, false
+			}
+			plausible = i
+		}
+	}
+	if plausible < 0 {
+		return "", 0, false
+	}
+	return libnames[plausible], pixelsizes[plausible], true
+}
+
+// V0Bucket is an old bucket and the lib and pixel size it holds.
+type V0Bucket struct {
+	name      string
+	libname   string
+	pixelsize int
+}
+
+// v0_buckets returns the old buckets, and the names of those without a single
+// reading.
+func v0_buckets(tx *bolt.Tx) ([]V0Bucket, []string) {
+	var buckets []V0Bucket
+	var skipped []string
+	tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if strings.HasPrefix(string(name), "FileInfo") {
+			if libname, pixelsize, ok := v0_bucket_lib(string(name)); ok {
+				buckets = append(buckets, V0Bucket{string(name), libname, pixelsize})
+			} else {
+				skipped = append(skipped, string(name))
+			}
+		}
+		return nil
+	})
+	return buckets, skipped
+}
+
+// migrate_v4 moves the old FileInfo<libname><pixelsize> buckets to the lib
+// buckets: a lib takes the deepest directory shared by its files as root, the
+// copies of one content become one entry listing all their files, and the
+// orientation and crop are read from the file header, files not online get them
+// on the next load_lib. migrate_batch entries per transaction, an entry done is
+// found in the lib, so a failed run goes on where it stopped. The old buckets
+// are dropped by migrate_v4_drop.
+func migrate_v4(db *bolt.DB) error {
+	var buckets []V0Bucket
+	roots := make(map[string]string)
+	db.View(func(tx *bolt.Tx) error {
+		var skipped []string
+		buckets, skipped = v0_buckets(tx)
+		for _, name := range skipped {
+			loggo.Error("migrate_v4 bucket %s has no single lib and pixelsize reading, skip, load the lib again to rebuild it", name)
+		}
+		for _, ob := range buckets {
+			tx.Bucket([]byte(ob.name)).ForEach(func(k, v []byte) error {
+				dir := filepath.Dir(filepath.FromSlash(string(k)))
+				root, ok := roots[ob.libname]
+				if !ok {
+					roots[ob.libname] = dir
+					return nil
+				}
+				for root != dir && !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+					parent := filepath.Dir(root)
+					if parent == root {
+						break
+					}
+					root = parent
+				}
+				roots[ob.libname] = root
+				return nil
+			})
+		}
+		return nil
+	})
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, ob := range buckets {
+			for _, name := range []string{make_lib_bucket(ob.libname), make_path_bucket(ob.libname), make_tile_bucket(ob.libname, ob.pixelsize)} {
+				_, err := tx.CreateBucketIfNotExists([]byte(name))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for libname, root := range roots {
+			err := set_lib_root(tx, libname, root)
+			if err != nil {
+				return err
+			}
+			loggo.Info("migrate_v4 lib %s root %s", libname, root)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	type entry struct {
+		key string
+		fi  FileInfoV0
+		// read from the file for a content not in the lib yet
+		orientation int
+		crop        image.Rectangle
+		known       bool
+	}
+	for _, ob := range buckets {
+		root := roots[ob.libname]
+		var next []byte
+		num := 0
+		for {
+			var batch []entry
+			// the entries of a batch are read first, the files outside any transaction
+			db.View(func(tx *bolt.Tx) error {
+				lb := tx.Bucket([]byte(make_lib_bucket(ob.libname)))
+				c := tx.Bucket([]byte(ob.name)).Cursor()
+				k, v := c.First()
+				if next != nil {
+					k, v = c.Seek(next)
+				}
+				next = nil
+				for n := 0; k != nil; k, v = c.Next() {
+					if n == migrate_batch {
+						next = append([]byte(nil), k...)
+						break
+					}
+					n++
+					fi, err := decode_file_info_v0(v)
+					if err != nil || fi.Hash == "" {
+						loggo.Error("migrate_v4 bad entry, skip %s %s %v", ob.name, string(k), err)
+						continue
+					}
+					rel, ok := path_within(root, filepath.FromSlash(string(k)))
+					if !ok {
+						loggo.Error("migrate_v4 entry out of the lib root, skip %s %s %s", ob.name, root, string(k))
+						continue
+					}
+					batch = append(batch, entry{key: filepath.ToSlash(rel), fi: fi, known: lb.Get([]byte(fi.Hash)) != nil})
+				}
+				return nil
+			})
+
+			read := make(map[string]int)
+			for i := range batch {
+				e := &batch[i]
+				if e.known {
+					continue
+				}
+				if j, ok := read[e.fi.Hash]; ok {
+					e.orientation, e.crop = batch[j].orientation, batch[j].crop
+					continue
+				}
+				read[e.fi.Hash] = i
+				e.orientation = read_orientation(e.fi.Filename)
+				e.crop = calc_file_crop(e.fi.Filename, e.orientation)
+			}
+
+			err := db.Update(func(tx *bolt.Tx) error {
+				lb := tx.Bucket([]byte(make_lib_bucket(ob.libname)))
+				pb := tx.Bucket([]byte(make_path_bucket(ob.libname)))
+				tb := tx.Bucket([]byte(make_tile_bucket(ob.libname, ob.pixelsize)))
+				for _, e := range batch {
+					k := []byte(e.fi.Hash)
+					fi := FileInfo{Hash: e.fi.Hash, Orientation: e.orientation, Crop: e.crop}
+					if old := lb.Get(k); old != nil {
+						ofi, err := decode_file_info(old)
+						if err != nil {
+							return err
+						}
+						fi = ofi
+					}
+					if !has_path(fi.Paths, e.key) {
+						fi.Paths = append(fi.Paths, e.key)
+					}
+					v, err := encode_file_info(&fi)
+					if err != nil {
+						return err
+					}
+					err = lb.Put(k, v)
+					if err != nil {
+						return err
+					}
+					err = pb.Put([]byte(e.key), k)
+					if err != nil {
+						return err
+					}
+					// the copy first migrated keeps the tile
+					if tb.Get(k) == nil {
+						tv, err := encode_tile_info(&TileInfo{R: e.fi.R, G: e.fi.G, B: e.fi.B})
+						if err != nil {
+							return err
+						}
+						err = tb.Put(k, tv)
+						if err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			num += len(batch)
+			if next == nil {
+				break
+			}
+		}
+		loggo.Info("migrate_v4 %s to lib %s pixelsize %d files %d", ob.name, ob.libname, ob.pixelsize, num)
+	}
+
+	return nil
+}
+
+// migrate_v4_drop drops the old buckets moved by migrate_v4.
+func migrate_v4_drop(tx *bolt.Tx) error {
+	buckets, _ := v0_buckets(tx)
+	for _, ob := range buckets {
+		err := tx.DeleteBucket([]byte(ob.name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"github.com/boltdb/bolt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func open_test_db(t *testing.T) *bolt.DB {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.bin"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func put_test(t *testing.T, db *bolt.DB, bucket string, k string, v []byte) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(k), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func bucket_names(t *testing.T, db *bolt.DB) []string {
+	var names []string
+	db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+	return names
+}
+
+func TestV0NameReadings(t *testing.T) {
+	tests := []struct {
+		rest       string
+		libnames   []string
+		pixelsizes []int
+	}{
+		{"default32", []string{"default3", "default"}, []int{2, 32}},
+		{"default4", []string{"default"}, []int{4}},
+		{"set264", []string{"set26", "set2", "set"}, []int{4, 64, 264}},
+		{"lib100", []string{"lib"}, []int{100}},
+		{"lib", nil, nil},
+		{"64", []string{"6"}, []int{4}},
+	}
+	for _, tt := range tests {
+		libnames, pixelsizes := v0_name_readings(tt.rest)
+		if !reflect.DeepEqual(libnames, tt.libnames) || !reflect.DeepEqual(pixelsizes, tt.pixelsizes) {
+			t.Errorf("v0_name_readings(%q) = %v %v, want %v %v", tt.rest, libnames, pixelsizes, tt.libnames, tt.pixelsizes)
+		}
+	}
+}
+
+func run_migrate_v4(t *testing.T, db *bolt.DB) {
+	err := migrate_v4(db)
+	if err == nil {
+		err = db.Update(migrate_v4_drop)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateV4Buckets(t *testing.T) {
+	fi, err := encode_file_info_v0(&FileInfoV0{Filename: "/lib/a.jpg", R: 1, G: 2, B: 3, Hash: "h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		bucket string
+		want   []string
+	}{
+		{"plain", "FileInfodefault32", []string{"Lib:default", "Path:default", root_bucket_name, "Tile:default:32"}},
+		{"one plausible size", "FileInfoabc2032", []string{"Lib:abc20", "Path:abc20", root_bucket_name, "Tile:abc20:32"}},
+		{"more plausible sizes", "FileInfoset264", []string{"FileInfoset264"}},
+		{"no size", "FileInfolib", []string{"FileInfolib"}},
+	}
+	for _, tt := range tests {
+		db := open_test_db(t)
+		put_test(t, db, tt.bucket, "/lib/a.jpg", fi)
+		run_migrate_v4(t, db)
+		if got := bucket_names(t, db); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: buckets %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMigrateV4Batch(t *testing.T) {
+	db := open_test_db(t)
+	num := migrate_batch*2 + 500
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("FileInfodefault32"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < num; i++ {
+			// every tenth file a copy of the one before
+			fi := FileInfoV0{Filename: fmt.Sprintf("/no/such/%05d.jpg", i), R: uint8(i), Hash: fmt.Sprintf("h%05d", i-i%10/9)}
+			v, err := encode_file_info_v0(&fi)
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(fi.Filename), v)
+			if err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte("/no/such/bad.jpg"), []byte("not gob"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a run broken before the old buckets are dropped is run again
+	err = migrate_v4(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run_migrate_v4(t, db)
+
+	db.View(func(tx *bolt.Tx) error {
+		if root := get_lib_root(tx, "default"); root != filepath.FromSlash("/no/such") {
+			t.Errorf("root %s, want /no/such", root)
+		}
+		if n := tx.Bucket([]byte(make_path_bucket("default"))).Stats().KeyN; n != num {
+			t.Errorf("paths %d, want %d", n, num)
+		}
+		contents := num - num/10
+		if n := tx.Bucket([]byte(make_tile_bucket("default", 32))).Stats().KeyN; n != contents {
+			t.Errorf("tiles %d, want %d", n, contents)
+		}
+		b := tx.Bucket([]byte(make_lib_bucket("default")))
+		if n := b.Stats().KeyN; n != contents {
+			t.Errorf("contents %d, want %d", n, contents)
+		}
+		fi, err := decode_file_info(b.Get([]byte("h00008")))
+		if err != nil || !reflect.DeepEqual(fi.Paths, []string{"00008.jpg", "00009.jpg"}) || fi.Orientation != orientation_normal {
+			t.Errorf("h00008 %v %v", fi, err)
+		}
+		return nil
+	})
+}
+
+func TestOpenDatabaseMigrate(t *testing.T) {
+	dir := t.TempDir()
+	database := filepath.Join(dir, "old.bin")
+	db, err := bolt.Open(database, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a version 0 database, a lib of two copies of one content and another content
+	for _, fi := range []FileInfoV0{
+		{Filename: "/pics/a/1.jpg", R: 10, Hash: "h1"},
+		{Filename: "/pics/b/1copy.jpg", R: 10, Hash: "h1"},
+		{Filename: "/pics/b/2.jpg", R: 20, Hash: "h2"},
+	} {
+		v, err := encode_file_info_v0(&fi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		put_test(t, db, "FileInfodefault32", fi.Filename, v)
+	}
+	db.Close()
+
+	db, err = open_database(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.View(func(tx *bolt.Tx) error {
+		if v := string(tx.Bucket([]byte(meta_bucket_name)).Get([]byte(meta_version_key))); v != fmt.Sprint(db_version) {
+			t.Errorf("version %s, want %d", v, db_version)
+		}
+		if root := get_lib_root(tx, "default"); root != filepath.FromSlash("/pics") {
+			t.Errorf("root %s, want /pics", root)
+		}
+
+		paths := make(map[string]string)
+		tx.Bucket([]byte(make_path_bucket("default"))).ForEach(func(k, v []byte) error {
+			paths[string(k)] = string(v)
+			return nil
+		})
+		want := map[string]string{"a/1.jpg": "h1", "b/1copy.jpg": "h1", "b/2.jpg": "h2"}
+		if !reflect.DeepEqual(paths, want) {
+			t.Errorf("paths %v, want %v", paths, want)
+		}
+
+		b := tx.Bucket([]byte(make_lib_bucket("default")))
+		if n := b.Stats().KeyN; n != 2 {
+			t.Errorf("contents %d, want 2", n)
+		}
+		fi, err := decode_file_info(b.Get([]byte("h1")))
+		if err != nil || !reflect.DeepEqual(fi.Paths, []string{"a/1.jpg", "b/1copy.jpg"}) {
+			t.Errorf("h1 paths %v %v", fi.Paths, err)
+		}
+
+		ti, err := decode_tile_info(tx.Bucket([]byte(make_tile_bucket("default", 32))).Get([]byte("h2")))
+		if err != nil || ti.R != 20 {
+			t.Errorf("h2 tile %v %v", ti, err)
+		}
+		return nil
+	})
+
+	if got := bucket_names(t, db); !reflect.DeepEqual(got, []string{"Lib:default", meta_bucket_name, "Path:default", root_bucket_name, "Tile:default:32"}) {
+		t.Errorf("buckets %v", got)
+	}
+}
+
+func TestPathWithin(t *testing.T) {
+	tests := []struct {
+		dir  string
+		path string
+		rel  string
+		ok   bool
+	}{
+		{"/pics", "/pics/a/1.jpg", "a/1.jpg", true},
+		{"/pics", "/pics", ".", true},
+		{"/pics", "/pics2/1.jpg", "", false},
+		{"/pics/a", "/pics/b/1.jpg", "", false},
+		{"/pics/a", "/pics", "", false},
+		{"/pics", "/pics/..a/1.jpg", "..a/1.jpg", true},
+	}
+	for _, tt := range tests {
+		rel, ok := path_within(filepath.FromSlash(tt.dir), filepath.FromSlash(tt.path))
+		if filepath.ToSlash(rel) != tt.rel || ok != tt.ok {
+			t.Errorf("path_within(%q, %q) = %q %v, want %q %v", tt.dir, tt.path, rel, ok, tt.rel, tt.ok)
+		}
+	}
+}
+
+func TestRekeyLibPaths(t *testing.T) {
+	db := open_test_db(t)
+	fi, err := encode_file_info(&FileInfo{Hash: "h1", Paths: []string{"a/1.jpg", "b/1copy.jpg"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put_test(t, db, make_lib_bucket("default"), "h1", fi)
+	put_test(t, db, make_path_bucket("default"), "a/1.jpg", []byte("h1"))
+	put_test(t, db, make_path_bucket("default"), "b/1copy.jpg", []byte("h1"))
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return rekey_lib_paths(tx, "default", "sub/dir")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		paths := make(map[string]string)
+		tx.Bucket([]byte(make_path_bucket("default"))).ForEach(func(k, v []byte) error {
+			paths[string(k)] = string(v)
+			return nil
+		})
+		want := map[string]string{"sub/dir/a/1.jpg": "h1", "sub/dir/b/1copy.jpg": "h1"}
+		if !reflect.DeepEqual(paths, want) {
+			t.Errorf("paths %v, want %v", paths, want)
+		}
+		fi, err := decode_file_info(tx.Bucket([]byte(make_lib_bucket("default"))).Get([]byte("h1")))
+		if err != nil || !reflect.DeepEqual(fi.Paths, []string{"sub/dir/a/1.jpg", "sub/dir/b/1copy.jpg"}) {
+			t.Errorf("h1 paths %v %v", fi.Paths, err)
+		}
+		return nil
+	})
+}
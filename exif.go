@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/image/draw"
+	"image"
+	"io"
+	"os"
+)
+
+const (
+	orientation_normal = 1
+	exif_tag_orient    = 0x0112
+)
+
+// read_orientation returns the EXIF orientation 1-8 of the file, 1 when there is none.
+func read_orientation(filename string) int {
+	reader, err := os.Open(filename)
+	if err != nil {
+		return orientation_normal
+	}
+	defer reader.Close()
+
+	return exif_orientation(reader)
+}
+
+func exif_orientation(r io.ReaderAt) int {
+	o := exif_orientation_raw(r)
+	if o < 1 || o > 8 {
+		return orientation_normal
+	}
+	return o
+}
+
+func exif_orientation_raw(r io.ReaderAt) int {
+	head := make([]byte, 12)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+
+	if bytes.HasPrefix(head, []byte{0xFF, 0xD8}) {
+		return jpeg_orientation(r)
+	} else if bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")) {
+		return tiff_orientation(r, 0)
+	} else if len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WEBP" {
+		return webp_orientation(r)
+	}
+	return orientation_normal
+}
+
+func jpeg_orientation(r io.ReaderAt) int {
+	off := int64(2)
+	seg := make([]byte, 10)
+	for {
+		n, _ := r.ReadAt(seg, off)
+		if n < 4 || seg[0] != 0xFF {
+			return orientation_normal
+		}
+		marker := seg[1]
+		// start of scan or end of image, no more metadata
+		if marker == 0xDA || marker == 0xD9 {
+			return orientation_normal
+		}
+		size := int64(binary.BigEndian.Uint16(seg[2:4]))
+		if marker == 0xE1 && n >= 10 && string(seg[4:10]) == "Exif\x00\x00" {
+			return tiff_orientation(r, off+10)
+		}
+		off += 2 + size
+	}
+}
+
+func webp_orientation(r io.ReaderAt) int {
+	off := int64(12)
+	chunk := make([]byte, 8)
+	for {
+		n, _ := r.ReadAt(chunk, off)
+		if n < 8 {
+			return orientation_normal
+		}
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		if string(chunk[0:4]) == "EXIF" {
+			// some writers keep the jpeg style prefix
+			prefix := make([]byte, 6)
+			r.ReadAt(prefix, off+8)
+			if string(prefix) == "Exif\x00\x00" {
+				return tiff_orientation(r, off+14)
+			}
+			return tiff_orientation(r, off+8)
+		}
+		off += 8 + size + size%2
+	}
+}
+
+// tiff_orientation reads the orientation tag of IFD0 from a tiff structure starting at base.
+func tiff_orientation(r io.ReaderAt, base int64) int {
+	head := make([]byte, 8)
+	n, _ := r.ReadAt(head, base)
+	if n < 8 {
+		return orientation_normal
+	}
+
+	var order binary.ByteOrder
+	if string(head[0:2]) == "II" {
+		order = binary.LittleEndian
+	} else if string(head[0:2]) == "MM" {
+		order = binary.BigEndian
+	} else {
+		return orientation_normal
+	}
+
+	ifd := base + int64(order.Uint32(head[4:8]))
+	count := make([]byte, 2)
+	n, _ = r.ReadAt(count, ifd)
+	if n < 2 {
+		return orientation_normal
+	}
+
+	entry := make([]byte, 12)
+	for i := 0; i < int(order.Uint16(count)); i++ {
+		n, _ = r.ReadAt(entry, ifd+2+int64(i)*12)
+		if n < 12 {
+			return orientation_normal
+		}
+		if order.Uint16(entry[0:2]) == exif_tag_orient {
+			return int(order.Uint16(entry[8:10]))
+		}
+	}
+	return orientation_normal
+}
+
+// apply_orientation turns the decoded image upright according to the EXIF orientation.
+func apply_orientation(img image.Image, o int) image.Image {
+	if o <= orientation_normal || o > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	src, ok := img.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) {
+		src = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	}
+
+	w := bounds.Dx()
+	h := bounds.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			si := src.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+
+	return dst
+}
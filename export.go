@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/esrrhs/gohome/loggo"
+	"image"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const export_format = "go-mosaic-lib"
+
+// The export file is JSON lines, one ExportHeader then one ExportFile per
+// library content, gzip compressed when the name ends with .gz. Paths are
+// relative to Root, or absolute when Root is empty. Exports before version 4
+// have one Filename instead of Paths.
+type ExportHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Lib     string `json:"lib"`
+	Root    string `json:"root,omitempty"`
+}
+
+type ExportFile struct {
+	Paths       []string              `json:"paths"`
+	Filename    string                `json:"filename,omitempty"`
+	Hash        string                `json:"hash"`
+	Orientation int                   `json:"orientation"`
+	Crop        [4]int                `json:"crop"`
+	DHash       string                `json:"dhash,omitempty"`
+	Preview     []byte                `json:"preview,omitempty"`
+	Tiles       map[string]ExportTile `json:"tiles"`
+}
+
+type ExportTile struct {
+	R     uint8  `json:"r"`
+	G     uint8  `json:"g"`
+	B     uint8  `json:"b"`
+	Thumb []byte `json:"thumb,omitempty"`
+}
+
+func export_lib(database string, libname string, filename string) error {
+	loggo.Info("export_lib %s %s to %s", database, libname, filename)
+
+	db, err := open_database(database)
+	if err != nil {
+		loggo.Error("export_lib Open database fail %s %s", database, err)
+		return err
+	}
+	defer db.Close()
+
+	file, err := os.Create(filename)
+	if err != nil {
+		loggo.Error("export_lib Create fail %s %s", filename, err)
+		return err
+	}
+
+	var w io.Writer = file
+	var gw *gzip.Writer
+	if strings.HasSuffix(strings.ToLower(filename), ".gz") {
+		gw = gzip.NewWriter(file)
+		w = gw
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	total := 0
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(make_lib_bucket(libname)))
+		if b == nil {
+			return errors.New("no lib " + libname)
+		}
+
+		root := filepath.ToSlash(get_lib_root(tx, libname))
+		err := enc.Encode(&ExportHeader{Format: export_format, Version: db_version, Lib: libname, Root: root})
+		if err != nil {
+			return err
+		}
+
+		// pixel size of every Tile/Thumb bucket of the lib
+		tiles := make(map[string]*bolt.Bucket)
+		thumbs := make(map[string]*bolt.Bucket)
+		for _, name := range lib_sub_buckets(tx, libname) {
+			pixelsize := name[strings.LastIndex(name, ":")+1:]
+			if strings.HasPrefix(name, "Tile:") {
+				tiles[pixelsize] = tx.Bucket([]byte(name))
+			} else if strings.HasPrefix(name, "Thumb:") {
+				thumbs[pixelsize] = tx.Bucket([]byte(name))
+			}
+		}
+		previews := tx.Bucket([]byte(make_preview_bucket(libname)))
+
+		return b.ForEach(func(k, v []byte) error {
+			fi, err := decode_file_info(v)
+			if err != nil {
+				loggo.Error("export_lib Decode fail, skip %s %s", string(k), err)
+				return nil
+			}
+
+			ef := ExportFile{
+				Paths:       fi.Paths,
+				Hash:        fi.Hash,
+				Orientation: fi.Orientation,
+				Crop:        [4]int{fi.Crop.Min.X, fi.Crop.Min.Y, fi.Crop.Max.X, fi.Crop.Max.Y},
+				Tiles:       make(map[string]ExportTile),
+			}
+			if fi.HasDHash {
+				ef.DHash = strconv.FormatUint(fi.DHash, 16)
+			}
+			if previews != nil {
+				ef.Preview = previews.Get(k)
+			}
+			for pixelsize, tb := range tiles {
+				tv := tb.Get(k)
+				if tv == nil {
+					continue
+				}
+				ti, err := decode_tile_info(tv)
+				if err != nil {
+					continue
+				}
+				et := ExportTile{R: ti.R, G: ti.G, B: ti.B}
+				if thumbs[pixelsize] != nil {
+					et.Thumb = thumbs[pixelsize].Get(k)
+				}
+				ef.Tiles[pixelsize] = et
+			}
+
+			total++
+			return enc.Encode(&ef)
+		})
+	})
+	// a full disk shows up when the buffers are written out
+	if err == nil {
+		err = bw.Flush()
+	}
+	if gw != nil {
+		if cerr := gw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		loggo.Error("export_lib fail %s %s", filename, err)
+		return err
+	}
+
+	loggo.Info("export_lib ok %s %d contents", filename, total)
+	return nil
+}
+
+// parse_rewrite parses "old=new,old2=new2" path prefix rewrites.
+func parse_rewrite(rewrite string) ([][2]string, error) {
+	var ret [][2]string
+	if rewrite == "" {
+		return ret, nil
+	}
+	for _, kv := range strings.Split(rewrite, ",") {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, errors.New("rewrite format error " + kv)
+		}
+		ret = append(ret, [2]string{filepath.ToSlash(kv[:i]), filepath.ToSlash(kv[i+1:])})
+	}
+	return ret, nil
+}
+
+// rewrite_path replaces the first matching prefix, whole path components only,
+// so /photos does not rewrite /photos2.
+func rewrite_path(filename string, rewrite [][2]string) string {
+	for _, r := range rewrite {
+		prefix := strings.TrimSuffix(r[0], "/")
+		if filename != prefix && !strings.HasPrefix(filename, prefix+"/") {
+			continue
+		}
+		rest := filename[len(prefix):]
+		if rest == "" {
+			return r[1]
+		}
+		return strings.TrimSuffix(r[1], "/") + rest
+	}
+	return filename
+}
+
+// import_lib merges the export files into libname, content already in the lib
+// gets the missing paths and pixel sizes, a path holding another content is replaced.
+func import_lib(database string, libname string, filenames []string, rewrite string) error {
+	rw, err := parse_rewrite(rewrite)
+	if err != nil {
+		loggo.Error("import_lib %s", err)
+		return err
+	}
+
+	db, err := open_database(database)
+	if err != nil {
+		loggo.Error("import_lib Open database fail %s %s", database, err)
+		return err
+	}
+	defer db.Close()
+
+	for _, filename := range filenames {
+		err := import_lib_file(db, libname, filename, rw)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func import_lib_file(db *bolt.DB, libname string, filename string, rewrite [][2]string) error {
+	loggo.Info("import_lib %s to %s", filename, libname)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		loggo.Error("import_lib Open fail %s %s", filename, err)
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(strings.ToLower(filename), ".gz") {
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			loggo.Error("import_lib gzip fail %s %s", filename, err)
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var header ExportHeader
+	err = dec.Decode(&header)
+	if err != nil || header.Format != export_format {
+		loggo.Error("import_lib not a go-mosaic export %s %v", filename, err)
+		return errors.New("bad export file")
+	}
+	if header.Version > db_version {
+		loggo.Error("import_lib %s is version %d, newer than %d supported by this go-mosaic, please upgrade go-mosaic", filename, header.Version, db_version)
+		return errors.New("export version too new")
+	}
+
+	added := 0
+	merged := 0
+	replaced := 0
+	eof := false
+	for !eof {
+		// write in batches, one transaction per file is too slow for big libs
+		err = db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte(make_lib_bucket(libname)))
+			if err != nil {
+				return err
+			}
+			pb, err := tx.CreateBucketIfNotExists([]byte(make_path_bucket(libname)))
+			if err != nil {
+				return err
+			}
+
+			// a new lib takes the root of the first import
+			root := get_lib_root(tx, libname)
+			if root == "" && header.Root != "" {
+				root = filepath.FromSlash(rewrite_path(header.Root, rewrite))
+				err = set_lib_root(tx, libname, root)
+				if err != nil {
+					return err
+				}
+			}
+
+			for i := 0; i < 1000; i++ {
+				var ef ExportFile
+				err := dec.Decode(&ef)
+				if err == io.EOF {
+					eof = true
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if ef.Hash == "" {
+					continue
+				}
+				if len(ef.Paths) == 0 && ef.Filename != "" {
+					ef.Paths = []string{ef.Filename}
+				}
+
+				k := []byte(ef.Hash)
+
+				var paths []string
+				for _, p := range ef.Paths {
+					full := p
+					if header.Root != "" && !filepath.IsAbs(filepath.FromSlash(full)) {
+						full = path.Join(header.Root, full)
+					}
+					libfile := filepath.FromSlash(rewrite_path(full, rewrite))
+					if root == "" && filepath.IsAbs(libfile) {
+						// no root given, keyed from the top directory, a lib loaded
+						// later below it keeps the root
+						root = filepath.VolumeName(libfile) + string(filepath.Separator)
+						err := set_lib_root(tx, libname, root)
+						if err != nil {
+							return err
+						}
+					}
+					rel, ok := path_within(root, libfile)
+					if root == "" || !ok {
+						loggo.Error("import_lib path out of the lib root, skip %s %s", root, libfile)
+						continue
+					}
+					libfile = filepath.ToSlash(rel)
+
+					// another content under the same name, drop it and its stale derived data
+					if old := pb.Get([]byte(libfile)); old != nil && string(old) != ef.Hash {
+						err := remove_lib_path(tx, libname, libfile)
+						if err != nil {
+							return err
+						}
+						replaced++
+					}
+					paths = append(paths, libfile)
+				}
+				if len(paths) == 0 {
+					continue
+				}
+
+				fi := FileInfo{
+					Hash:        ef.Hash,
+					Paths:       paths,
+					Orientation: ef.Orientation,
+					Crop:        image.Rect(ef.Crop[0], ef.Crop[1], ef.Crop[2], ef.Crop[3]),
+				}
+				if ef.DHash != "" {
+					fi.DHash, err = strconv.ParseUint(ef.DHash, 16, 64)
+					fi.HasDHash = err == nil
+				}
+
+				old := b.Get(k)
+				if old != nil {
+					ofi, err := decode_file_info(old)
+					if err == nil {
+						for _, p := range fi.Paths {
+							if !has_path(ofi.Paths, p) {
+								ofi.Paths = append(ofi.Paths, p)
+							}
+						}
+						if !ofi.HasDHash {
+							ofi.DHash, ofi.HasDHash = fi.DHash, fi.HasDHash
+						}
+						fi = ofi
+					}
+					merged++
+				} else {
+					added++
+				}
+
+				v, err := encode_file_info(&fi)
+				if err != nil {
+					return err
+				}
+				err = b.Put(k, v)
+				if err != nil {
+					return err
+				}
+				for _, p := range paths {
+					err = pb.Put([]byte(p), k)
+					if err != nil {
+						return err
+					}
+				}
+
+				if len(ef.Preview) > 0 {
+					prb, err := tx.CreateBucketIfNotExists([]byte(make_preview_bucket(libname)))
+					if err != nil {
+						return err
+					}
+					if prb.Get(k) == nil {
+						err = prb.Put(k, ef.Preview)
+						if err != nil {
+							return err
+						}
+					}
+				}
+
+				for pixelsize, et := range ef.Tiles {
+					ps, err := strconv.Atoi(pixelsize)
+					if err != nil {
+						continue
+					}
+					tb, err := tx.CreateBucketIfNotExists([]byte(make_tile_bucket(libname, ps)))
+					if err != nil {
+						return err
+					}
+					if tb.Get(k) == nil {
+						tv, err := encode_tile_info(&TileInfo{R: et.R, G: et.G, B: et.B})
+						if err != nil {
+							return err
+						}
+						err = tb.Put(k, tv)
+						if err != nil {
+							return err
+						}
+					}
+					if len(et.Thumb) > 0 {
+						thb, err := tx.CreateBucketIfNotExists([]byte(make_thumb_bucket(libname, ps)))
+						if err != nil {
+							return err
+						}
+						if thb.Get(k) == nil {
+							err = thb.Put(k, et.Thumb)
+							if err != nil {
+								return err
+							}
+						}
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			loggo.Error("import_lib fail %s %s", filename, err)
+			return err
+		}
+	}
+
+	loggo.Info("import_lib ok %s added %d merged %d replaced %d", filename, added, merged, replaced)
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseRewrite(t *testing.T) {
+	tests := []struct {
+		rewrite string
+		want    [][2]string
+		err     bool
+	}{
+		{"", nil, false},
+		{"/a=/b", [][2]string{{"/a", "/b"}}, false},
+		{"/a=/b,/c=", [][2]string{{"/a", "/b"}, {"/c", ""}}, false},
+		{"/a", nil, true},
+		{"=/b", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parse_rewrite(tt.rewrite)
+		if (err != nil) != tt.err {
+			t.Errorf("parse_rewrite(%q) err %v, want err %v", tt.rewrite, err, tt.err)
+			continue
+		}
+		if !tt.err && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parse_rewrite(%q) = %v, want %v", tt.rewrite, got, tt.want)
+		}
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	rw := [][2]string{{"/photos", "/mnt/pics"}, {"/old/", "/new/"}, {"/", "/root/"}}
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"/photos/a.jpg", "/mnt/pics/a.jpg"},
+		{"/photos", "/mnt/pics"},
+		{"/photos2/a.jpg", "/root/photos2/a.jpg"},
+		{"/old/x/y.png", "/new/x/y.png"},
+		{"/older/y.png", "/root/older/y.png"},
+		{"relative/a.jpg", "relative/a.jpg"},
+	}
+	for _, tt := range tests {
+		if got := rewrite_path(tt.filename, rw); got != tt.want {
+			t.Errorf("rewrite_path(%q) = %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+
+	if got := rewrite_path("/photos2/a.jpg", [][2]string{{"/photos", "/mnt"}}); got != "/photos2/a.jpg" {
+		t.Errorf("rewrite_path matched a partial component, got %q", got)
+	}
+}
+
+func write_test_export(t *testing.T, header ExportHeader, files []ExportFile) string {
+	filename := filepath.Join(t.TempDir(), "lib.json")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	header.Format = export_format
+	header.Version = db_version
+	enc := json.NewEncoder(file)
+	err = enc.Encode(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ef := range files {
+		err = enc.Encode(ef)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filename
+}
+
+func lib_paths(t *testing.T, db *bolt.DB, libname string) map[string]string {
+	paths := make(map[string]string)
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(make_path_bucket(libname)))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			paths[string(k)] = string(v)
+			return nil
+		})
+	})
+	return paths
+}
+
+func TestImportLibFile(t *testing.T) {
+	files := []ExportFile{
+		{Paths: []string{"/pics/a.jpg"}, Hash: "h1", Tiles: map[string]ExportTile{"32": {R: 10, Thumb: []byte("thumb")}}},
+		{Paths: []string{"/other/b.jpg"}, Hash: "h2", Tiles: map[string]ExportTile{"32": {R: 20}}},
+	}
+
+	tests := []struct {
+		name  string
+		root  string
+		paths map[string]string
+		want  string
+	}{
+		{"out of the lib root", "/pics", map[string]string{"a.jpg": "h1"}, "/pics"},
+		{"no root", "", map[string]string{"pics/a.jpg": "h1", "other/b.jpg": "h2"}, "/"},
+	}
+	for _, tt := range tests {
+		db := open_test_db(t)
+		if tt.root != "" {
+			db.Update(func(tx *bolt.Tx) error {
+				return set_lib_root(tx, "default", filepath.FromSlash(tt.root))
+			})
+		}
+		err := import_lib_file(db, "default", write_test_export(t, ExportHeader{Lib: "default"}, files), nil)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got := lib_paths(t, db, "default"); !reflect.DeepEqual(got, tt.paths) {
+			t.Errorf("%s: paths %v, want %v", tt.name, got, tt.paths)
+		}
+		db.View(func(tx *bolt.Tx) error {
+			if root := get_lib_root(tx, "default"); root != filepath.FromSlash(tt.want) {
+				t.Errorf("%s: root %s, want %s", tt.name, root, tt.want)
+			}
+			return nil
+		})
+	}
+}
+
+func TestImportLibFileThumb(t *testing.T) {
+	db := open_test_db(t)
+	tv, err := encode_tile_info(&TileInfo{R: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put_test(t, db, make_tile_bucket("default", 32), "h1", tv)
+
+	files := []ExportFile{{Paths: []string{"a.jpg"}, Hash: "h1", Tiles: map[string]ExportTile{"32": {R: 10, Thumb: []byte("thumb")}}}}
+	err = import_lib_file(db, "default", write_test_export(t, ExportHeader{Lib: "default", Root: "/pics"}, files), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		ti, err := decode_tile_info(tx.Bucket([]byte(make_tile_bucket("default", 32))).Get([]byte("h1")))
+		if err != nil || ti.R != 1 {
+			t.Errorf("tile %v %v, want the one there before", ti, err)
+		}
+		if thumb := tx.Bucket([]byte(make_thumb_bucket("default", 32))).Get([]byte("h1")); string(thumb) != "thumb" {
+			t.Errorf("thumb %q, want imported", thumb)
+		}
+		return nil
+	})
+}
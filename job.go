@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"image"
+	"sort"
+	"sync"
+	"time"
+)
+
+// job_bucket_name maps a job id to its params, Job:<id> holds the tile key
+// chosen for every finished cell so a broken render can be resumed.
+const job_bucket_name = "Job"
+
+func make_job_bucket(job string) string {
+	return job_bucket_name + ":" + job
+}
+
+// job_params describes everything the choice of tiles depends on, the source
+// grid included, a job is only resumed with the same params.
+func job_params(srcimg image.Image, target string, libname string, pixelsize int, cellsize int, preview string, maxreuse int, neighbor int, neardist int,
+	top *TopSelect, mask *Mask, tone *Tone, layout *PrintLayout) string {
+	bounds := srcimg.Bounds()
+	pix := make([]byte, 0, bounds.Dx()*bounds.Dy()*4)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c, a := src_color(srcimg, x, y)
+			pix = append(pix, c.R, c.G, c.B, a)
+		}
+	}
+	topstr := "off"
+	if top != nil {
+		topstr = fmt.Sprintf("%d,%g,%g", top.k, top.dist, top.falloff)
+	}
+	return fmt.Sprintf("target=%s lib=%s pixelsize=%d cellsize=%d preview=%s maxreuse=%d neighbor=%d neardist=%d top=%s mask=%s tone=%s grid=%dx%d offset=%d,%d src=%s",
+		target, libname, pixelsize, cellsize, preview, maxreuse, neighbor, neardist, topstr, mask.signature(), tone, bounds.Dx(), bounds.Dy(), layout.offx, layout.offy,
+		common.GetXXHashString(string(pix)))
+}
+
+func job_cell_key(cell int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(cell))
+}
+
+// open_job returns the cells finished by an earlier run when resuming, else
+// starts the job over.
+func open_job(db *bolt.DB, job string, params string, resume bool) (map[int]string, error) {
+	done := make(map[int]string)
+	err := db.Update(func(tx *bolt.Tx) error {
+		jb, err := tx.CreateBucketIfNotExists([]byte(job_bucket_name))
+		if err != nil {
+			return err
+		}
+		old := jb.Get([]byte(job))
+
+		if resume && old != nil {
+			if string(old) != params {
+				loggo.Error("open_job %s params changed, can not resume, was %s now %s", job, string(old), params)
+				return errors.New("job params changed")
+			}
+			b := tx.Bucket([]byte(make_job_bucket(job)))
+			if b != nil {
+				b.ForEach(func(k, v []byte) error {
+					if len(k) == 4 {
+						done[int(binary.BigEndian.Uint32(k))] = string(v)
+					}
+					return nil
+				})
+			}
+			return nil
+		}
+		if resume {
+			loggo.Info("open_job %s nothing to resume, start over", job)
+		}
+
+		if tx.Bucket([]byte(make_job_bucket(job))) != nil {
+			err = tx.DeleteBucket([]byte(make_job_bucket(job)))
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.CreateBucket([]byte(make_job_bucket(job)))
+		if err != nil {
+			return err
+		}
+		return jb.Put([]byte(job), []byte(params))
+	})
+	return done, err
+}
+
+// finish_job drops the checkpoint once the target is written.
+func finish_job(db *bolt.DB, job string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		jb := tx.Bucket([]byte(job_bucket_name))
+		if jb != nil {
+			jb.Delete([]byte(job))
+		}
+		if tx.Bucket([]byte(make_job_bucket(job))) != nil {
+			return tx.DeleteBucket([]byte(make_job_bucket(job)))
+		}
+		return nil
+	})
+}
+
+// job_written_key marks the job of an animation frame written, the frame is
+// drawn from the saved cells only.
+const job_written_key = "written"
+
+func write_job(db *bolt.DB, job string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(make_job_bucket(job)))
+		if b == nil {
+			return errors.New("no job bucket")
+		}
+		return b.Put([]byte(job_written_key), []byte{1})
+	})
+}
+
+func job_written(db *bolt.DB, job string) bool {
+	written := false
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(make_job_bucket(job)))
+		written = b != nil && b.Get([]byte(job_written_key)) != nil
+		return nil
+	})
+	return written
+}
+
+// finish_jobs drops the jobs of the frames once the animation is written.
+func finish_jobs(database string, jobs []string) error {
+	db, err := open_database(database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, job := range jobs {
+		err = finish_job(db, job)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checkpoint collects finished cells and writes them in batches, one
+// transaction per cell would slow the render down to the disk sync speed.
+type Checkpoint struct {
+	db      *bolt.DB
+	bucket  string
+	lock    sync.Mutex
+	pending map[int]string
+	last    time.Time
+	saved   int
+}
+
+func new_checkpoint(db *bolt.DB, job string) *Checkpoint {
+	return &Checkpoint{db: db, bucket: make_job_bucket(job), pending: make(map[int]string), last: time.Now()}
+}
+
+func (cp *Checkpoint) add(cell int, key string) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	cp.pending[cell] = key
+	if len(cp.pending) >= 1000 || time.Now().Sub(cp.last) >= 5*time.Second {
+		cp.save()
+	}
+}
+
+func (cp *Checkpoint) flush() {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	cp.save()
+}
+
+func (cp *Checkpoint) save() {
+	cp.last = time.Now()
+	if len(cp.pending) == 0 {
+		return
+	}
+	err := cp.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(cp.bucket))
+		if b == nil {
+			return errors.New("no job bucket")
+		}
+		// bolt is much faster with keys put in order
+		cells := make([]int, 0, len(cp.pending))
+		for cell := range cp.pending {
+			cells = append(cells, cell)
+		}
+		sort.Ints(cells)
+		for _, cell := range cells {
+			err := b.Put(job_cell_key(cell), []byte(cp.pending[cell]))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		loggo.Error("checkpoint save fail %s %s", cp.bucket, err)
+		return
+	}
+	cp.saved += len(cp.pending)
+	cp.pending = make(map[int]string)
+}
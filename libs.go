@@ -0,0 +1,392 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"image/color"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LibRender is one lib of the database a render draws from.
+type LibRender struct {
+	name             string
+	weight           float64
+	root             string
+	bucket_name      string
+	tile_bucket_name string
+	draw_bucket_name string
+	total            int
+	// the tiles best matching a color
+	matchmap sync.Map
+	// with a tone the tiles by luminance, matched on it only
+	tone  *Tone
+	lumas [][]string
+}
+
+// LibMix picks the lib of a cell: at random by weight, or with priority the
+// first lib matching within threshold, else the lib matching best.
+type LibMix struct {
+	libs      []*LibRender
+	priority  bool
+	threshold float64
+}
+
+// parse_libs reads "name:weight,name..." into the libs and their weights, the
+// weight defaults to 1.
+func parse_libs(str string) ([]string, []float64, error) {
+	var names []string
+	var weights []float64
+	for _, s := range strings.Split(str, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		name := s
+		weight := 1.0
+		if i := strings.LastIndex(s, ":"); i >= 0 {
+			w, err := strconv.ParseFloat(s[i+1:], 64)
+			if err != nil || w <= 0 {
+				loggo.Error("parse_libs weight fail %s", s)
+				return nil, nil, errors.New("lib weight error")
+			}
+			name = s[:i]
+			weight = w
+		}
+		names = append(names, name)
+		weights = append(weights, weight)
+	}
+	return names, weights, nil
+}
+
+// parse_masklib reads "#rrggbb=name,..." mapping mask colors to libs.
+func parse_masklib(str string) (map[color.RGBA]string, error) {
+	ret := make(map[color.RGBA]string)
+	for _, s := range strings.Split(str, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		kv := strings.SplitN(s, "=", 2)
+		hex := strings.TrimPrefix(strings.TrimSpace(kv[0]), "#")
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if len(kv) != 2 || len(hex) != 6 || err != nil || kv[1] == "" {
+			loggo.Error("parse_masklib fail %s, use #rrggbb=libname", s)
+			return nil, errors.New("mask lib error")
+		}
+		ret[color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}] = strings.TrimSpace(kv[1])
+	}
+	return ret, nil
+}
+
+func open_lib_render(db *bolt.DB, name string, weight float64, pixelsize int, preview string, tone *Tone) (*LibRender, error) {
+	lr := &LibRender{
+		name:             name,
+		weight:           weight,
+		tone:             tone,
+		bucket_name:      make_lib_bucket(name),
+		tile_bucket_name: make_tile_bucket(name, pixelsize),
+		draw_bucket_name: make_thumb_bucket(name, pixelsize),
+	}
+	if preview != "" {
+		lr.draw_bucket_name = make_preview_bucket(name)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(lr.tile_bucket_name))
+		if b != nil {
+			lr.total = b.Stats().KeyN
+		}
+		lr.root = get_lib_root(tx, name)
+		if b == nil || tone == nil {
+			return nil
+		}
+		lr.lumas = make([][]string, 256)
+		return b.ForEach(func(k, v []byte) error {
+			ti, err := decode_tile_info(v)
+			if err != nil {
+				loggo.Error("open_lib_render Decode fail %s %s", string(k), err)
+				return nil
+			}
+			y := luma8(color.RGBA{ti.R, ti.G, ti.B, 0})
+			lr.lumas[y] = append(lr.lumas[y], string(k))
+			return nil
+		})
+	})
+	if lr.total <= 0 {
+		loggo.Error("open_lib_render no pic in database %s", lr.tile_bucket_name)
+		return nil, errors.New("no pic")
+	}
+	loggo.Info("open_lib_render %s weight %g tiles %d", name, weight, lr.total)
+	return lr, nil
+}
+
+// match returns the tiles of the lib for src, with the exact ties of the best
+// match or as top selects them.
+func (lr *LibRender) match(db *bolt.DB, src color.RGBA, top *TopSelect) *MatchList {
+	key := make_key(src.R, src.G, src.B)
+	if v, ok := lr.matchmap.Load(key); ok {
+		return v.(*MatchList)
+	}
+	if lr.lumas != nil {
+		ml := lr.match_luma(src, top)
+		lr.matchmap.Store(key, ml)
+		return ml
+	}
+
+	var mindiffs []string
+	var cands []MatchCand
+	mindiff := math.MaxFloat64
+	var minti TileInfo
+
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(lr.tile_bucket_name))
+		b.ForEach(func(k, v []byte) error {
+
+			ti, err := decode_tile_info(v)
+			if err != nil {
+				loggo.Error("gen_target_pixel database Decode fail %s %s", string(k), err)
+				os.Exit(1)
+			}
+
+			tmp := color.RGBA{ti.R, ti.G, ti.B, 0}
+			if top != nil {
+				cands = append(cands, MatchCand{hash: string(k), diff: common.ColorDistance(src, tmp)})
+				return nil
+			}
+
+			if minti.R == ti.R && minti.G == ti.G && minti.B == ti.B {
+				mindiffs = append(mindiffs, string(k))
+				return nil
+			}
+
+			diff := common.ColorDistance(src, tmp)
+			if diff < mindiff {
+				mindiff = diff
+				mindiffs = mindiffs[:0]
+				mindiffs = append(mindiffs, string(k))
+				minti = ti
+			}
+
+			return nil
+		})
+		return nil
+	})
+
+	var ml *MatchList
+	if top != nil {
+		ml = top.choose(cands)
+	} else {
+		ml = &MatchList{hashes: mindiffs, best: mindiff}
+	}
+	lr.matchmap.Store(key, ml)
+	return ml
+}
+
+// match_luma matches the gray src on the luminance index, the nearest non
+// empty luminance either side are the ties.
+func (lr *LibRender) match_luma(src color.RGBA, top *TopSelect) *MatchList {
+	y := int(src.R)
+	if top != nil {
+		var cands []MatchCand
+		for l, hashes := range lr.lumas {
+			diff := common.ColorDistance(src, color.RGBA{uint8(l), uint8(l), uint8(l), 0})
+			for _, hash := range hashes {
+				cands = append(cands, MatchCand{hash: hash, diff: diff})
+			}
+		}
+		return top.choose(cands)
+	}
+
+	ml := &MatchList{}
+	for d := 0; d < 256 && len(ml.hashes) == 0; d++ {
+		near := []int{y - d}
+		if d > 0 {
+			near = append(near, y+d)
+		}
+		for _, l := range near {
+			if l < 0 || l > 255 {
+				continue
+			}
+			if len(lr.lumas[l]) > 0 {
+				ml.hashes = append(ml.hashes, lr.lumas[l]...)
+				ml.best = common.ColorDistance(src, color.RGBA{uint8(l), uint8(l), uint8(l), 0})
+			}
+		}
+	}
+	return ml
+}
+
+func (mix *LibMix) String() string {
+	var names []string
+	for _, lr := range mix.libs {
+		names = append(names, fmt.Sprintf("%s:%g", lr.name, lr.weight))
+	}
+	if mix.priority {
+		return fmt.Sprintf("priority(%s)<=%g", strings.Join(names, ","), mix.threshold)
+	}
+	return strings.Join(names, ",")
+}
+
+// choose returns the lib drawn into a cell of color src and what it matched.
+func (mix *LibMix) choose(db *bolt.DB, src color.RGBA, top *TopSelect) (*LibRender, *MatchList) {
+	if len(mix.libs) == 1 {
+		return mix.libs[0], mix.libs[0].match(db, src, top)
+	}
+
+	if mix.priority {
+		var bestlr *LibRender
+		var bestml *MatchList
+		for _, lr := range mix.libs {
+			ml := lr.match(db, src, top)
+			if len(ml.hashes) == 0 {
+				continue
+			}
+			if ml.best <= mix.threshold {
+				return lr, ml
+			}
+			if bestml == nil || ml.best < bestml.best {
+				bestlr = lr
+				bestml = ml
+			}
+		}
+		if bestml == nil {
+			return mix.libs[0], &MatchList{}
+		}
+		return bestlr, bestml
+	}
+
+	total := 0.0
+	for _, lr := range mix.libs {
+		total += lr.weight
+	}
+	r := float64(common.RandInt31n(1<<30)) / (1 << 30) * total
+	pick := len(mix.libs) - 1
+	for i, lr := range mix.libs {
+		if r < lr.weight {
+			pick = i
+			break
+		}
+		r -= lr.weight
+	}
+	// the next lib when the picked one has nothing
+	for i := range mix.libs {
+		lr := mix.libs[(pick+i)%len(mix.libs)]
+		ml := lr.match(db, src, top)
+		if len(ml.hashes) > 0 {
+			return lr, ml
+		}
+	}
+	return mix.libs[pick], &MatchList{}
+}
+
+// LibSet is every lib of a render: the mixes the cells draw from, and for every
+// tile the lib to load it from.
+type LibSet struct {
+	libs  []*LibRender
+	mixes []*LibMix
+	// the mix of every cell, -1 for none
+	cells []int
+	libof map[string]*LibRender
+}
+
+// open_lib_set opens the libs, cells drawn from the default mix unless the mask
+// maps their color to a lib of its own.
+func open_lib_set(db *bolt.DB, names []string, weights []float64, priority bool, threshold float64, masklib map[color.RGBA]string,
+	mask *Mask, gridx int, gridy int, pixelsize int, preview string, tone *Tone) (*LibSet, error) {
+	ls := &LibSet{libof: make(map[string]*LibRender)}
+	byname := make(map[string]*LibRender)
+	open := func(name string, weight float64) (*LibRender, error) {
+		if lr, ok := byname[name]; ok {
+			return lr, nil
+		}
+		lr, err := open_lib_render(db, name, weight, pixelsize, preview, tone)
+		if err != nil {
+			return nil, err
+		}
+		byname[name] = lr
+		ls.libs = append(ls.libs, lr)
+		return lr, nil
+	}
+
+	mix := &LibMix{priority: priority, threshold: threshold}
+	for i, name := range names {
+		lr, err := open(name, weights[i])
+		if err != nil {
+			return nil, err
+		}
+		mix.libs = append(mix.libs, lr)
+	}
+	ls.mixes = append(ls.mixes, mix)
+
+	// sorted so the mix index of a color is the same every run
+	var colors []color.RGBA
+	for c := range masklib {
+		colors = append(colors, c)
+	}
+	sort.Slice(colors, func(i, j int) bool {
+		return make_key(colors[i].R, colors[i].G, colors[i].B) < make_key(colors[j].R, colors[j].G, colors[j].B)
+	})
+	mixof := make(map[color.RGBA]int)
+	for _, c := range colors {
+		lr, err := open(masklib[c], 1)
+		if err != nil {
+			return nil, err
+		}
+		mixof[c] = len(ls.mixes)
+		ls.mixes = append(ls.mixes, &LibMix{libs: []*LibRender{lr}})
+	}
+
+	ls.cells = make([]int, gridx*gridy)
+	num := make([]int, len(ls.mixes))
+	for i := range ls.cells {
+		if mask == nil {
+			continue
+		}
+		x := i % gridx
+		y := i / gridx
+		if !mask.mosaic(x, y) {
+			ls.cells[i] = -1
+			continue
+		}
+		if m, ok := mixof[mask.cells[i]]; ok {
+			ls.cells[i] = m
+		}
+	}
+	for _, m := range ls.cells {
+		if m >= 0 {
+			num[m]++
+		}
+	}
+	for i, mix := range ls.mixes {
+		loggo.Info("open_lib_set mix %s cells %d", mix, num[i])
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		for _, lr := range ls.libs {
+			tx.Bucket([]byte(lr.tile_bucket_name)).ForEach(func(k, v []byte) error {
+				if _, ok := ls.libof[string(k)]; !ok {
+					ls.libof[string(k)] = lr
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+
+	return ls, nil
+}
+
+func (ls *LibSet) signature() string {
+	var mixes []string
+	for _, mix := range ls.mixes {
+		mixes = append(mixes, mix.String())
+	}
+	return strings.Join(mixes, ";")
+}
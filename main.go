@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"encoding/gob"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,7 +9,10 @@ import (
 	"github.com/esrrhs/gohome/common"
 	"github.com/esrrhs/gohome/loggo"
 	"github.com/esrrhs/gohome/threadpool"
+	_ "golang.org/x/image/bmp"
 	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 	"image"
 	"image/color"
 	_ "image/gif"
@@ -18,10 +20,12 @@ import (
 	_ "image/jpeg"
 	"image/png"
 	_ "image/png"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,7 +39,7 @@ func main() {
 
 	src := flag.String("src", "", "src image path")
 	target := flag.String("target", "", "target image path")
-	lib := flag.String("lib", "", "image lib path")
+	lib := flag.String("lib", "", "image lib path, empty to use the lib already in database")
 	worker := flag.Int("worker", 12, "worker thread num")
 	database := flag.String("database", "./database.bin", "cache datbase")
 	pixelsize := flag.Int("pixelsize", 64, "pic scale size per one pixel")
@@ -44,11 +48,113 @@ func main() {
 	maxsize := flag.Int("maxsize", 4, "pic max size in GB")
 	libname := flag.String("libname", "default", "image lib name in database")
 	srcsize := flag.Int("srcsize", 128, "src image auto scale pixel size")
+	printwidth := flag.Float64("printwidth", 0, "print width, pixelsize and grid are computed from print size, dpi and srcsize")
+	printheight := flag.Float64("printheight", 0, "print height")
+	printunit := flag.String("printunit", "cm", "print size unit cm/mm/inch")
+	dpi := flag.Int("dpi", 0, "output dpi written into png/jpg metadata, default 300 when print size set")
+	bleed := flag.Float64("bleed", 0, "print bleed margin per side in printunit")
+	cropmarks := flag.Bool("cropmarks", false, "draw crop marks outside the bleed")
+	tiffcompress := flag.Bool("tiffcompress", true, "deflate compress tif target tiles")
+	bigtiff := flag.Bool("bigtiff", false, "always write tif target as BigTIFF, otherwise only when bigger than 4G")
+	thumbformat := flag.String("thumbformat", "jpg", "scaled pic format cached in database png/jpg")
+	export := flag.String("export", "", "export the lib libname in database to this file (json lines, .gz to compress) and exit")
+	importfile := flag.String("import", "", "import exported files, comma separated, merged into the lib libname in database and exit")
+	rewrite := flag.String("rewrite", "", "path prefix rewrite on import, old=new, comma separated")
+	reroot := flag.String("reroot", "", "set the root path of the lib libname in database, after the lib directory was moved, and exit")
+	stats := flag.Bool("stats", false, "print the stats, duplicate files and near duplicate pics of the lib libname in database and exit")
+	neardist := flag.Int("neardist", 6, "max dhash bit difference of near duplicate pics, -1 to only treat identical files as one pic")
+	coverage := flag.String("coverage", "", "analyze how the lib libname in database covers colors, and src if set, write the chart png here and the report next to it with .txt, and exit")
+	coveragetop := flag.Int("coveragetop", 16, "number of colors recommended by coverage")
+	preview := flag.String("preview", "", "fast preview render with tiny tiles, tile to draw the cached preview thumbs, flat to draw the tile average colors")
+	job := flag.String("job", "", "job id of the render checkpoint in database, default derived from src, target and the render params")
+	resume := flag.Bool("resume", false, "resume the broken render of the same job, cells already finished are only drawn again")
+	report := flag.String("report", "", "quality report json path, default the target name with .json, none to skip")
+	maxreuse := flag.Int("maxreuse", 0, "max times one pic and its near duplicates are used in target, 0 no limit")
+	neighbor := flag.Int("neighbor", 0, "cells around a pic where it and its near duplicates are not used again, 0 off")
+	topk := flag.Int("topk", 0, "pick from the k best matching pics instead of only the exact ties of the best, without maxreuse/neighbor, 0 off")
+	topdist := flag.Float64("topdist", 0, "pick from all pics within this color distance of the best match, without maxreuse/neighbor, 0 off")
+	topfalloff := flag.Float64("topfalloff", 10, "with topk/topdist a pic is picked less often by exp(-distance from the best/topfalloff), 0 all alike")
+	transform := flag.String("transform", "hflip", "transforms a pic may get when drawn, comma separated none/hflip/vflip/rot90/rot180/rot270, with rotations the best matching one is used, else a random one")
+	mask := flag.String("mask", "", "mask image stretched over src, cells where it is black keep the src photo, the rest become mosaic")
+	maskrect := flag.String("maskrect", "", "rects x,y,w,h in src pixels added to the mask as mosaic, ; separated")
+	maskpoly := flag.String("maskpoly", "", "polygons x,y x,y x,y... in src pixels added to the mask as mosaic, ; separated")
+	maskinvert := flag.Bool("maskinvert", false, "swap the mosaic and photo cells of the mask")
+	libs := flag.String("libs", "", "libs in database to draw from, name:weight comma separated, default libname")
+	libmode := flag.String("libmode", "weight", "how libs mix, weight picks the lib of a cell at random by weight, priority the first lib matching within libthreshold else the best matching one, maxreuse/neighbor draw from all alike")
+	libthreshold := flag.Float64("libthreshold", 30, "max color distance a lib may miss a cell by before the next one is tried, with libmode priority")
+	masklib := flag.String("masklib", "", "mask colors drawn from a lib of their own, #rrggbb=libname comma separated")
+	grout := flag.Int("grout", 0, "gap between tiles in pixels, 0 none")
+	groutcolor := flag.String("groutcolor", "#ffffff", "grout color #rrggbb, or src for the color of the src cell")
+	corner := flag.Int("corner", 0, "rounded tile corner radius in pixels, 0 square")
+	shadow := flag.Int("shadow", 0, "drop shadow offset of tiles on the grout in pixels, 0 none")
+	alpha := flag.String("alpha", "skip", "transparent src, skip leaves fully transparent cells out, fade also makes tiles as transparent as their cell, off draws every cell opaque")
+	tone := flag.String("tone", "", "monochrome mosaic gray/sepia/duotone, src and pics are matched on luminance only, empty for color")
+	duotone := flag.String("duotone", "#1b2a49,#f4e3c1", "dark and light color of the duotone tone, #rrggbb,#rrggbb")
+	coherence := flag.Float64("coherence", 20, "animated src, a cell keeps the tile of the frame before until its color moves more than this distance, 0 picks every frame anew")
+	buildup := flag.String("buildup", "", "also write a clip of the mosaic assembling here, a gif or frame files name_0000.png on")
+	buildorder := flag.String("buildorder", "scan", "order the cells appear in the buildup clip scan/random/color, none shows all from the start")
+	buildzoom := flag.String("buildzoom", "none", "buildup clip zoom none, out from a single tile to the full picture, in the other way")
+	buildfocus := flag.String("buildfocus", "", "cell x,y the buildup clip zooms on, default the center")
+	buildframes := flag.Int("buildframes", 48, "frames of the buildup clip")
+	buildwidth := flag.Int("buildwidth", 480, "width of the buildup clip frames in pixel")
+	builddelay := flag.Int("builddelay", 4, "delay of a buildup clip frame in 1/100s")
+	framedelay := flag.Int("framedelay", 10, "animated src, delay of a frame in 1/100s for a frame directory or gif frames without one")
+	cachemem := flag.Int("cachemem", 512, "memory limit of the decoded tile cache in MB shared by all workers, 0 no cache")
 
 	flag.Parse()
 
-	if *src == "" || *target == "" || *lib == "" {
-		fmt.Println("need src target lib")
+	level := loggo.LEVEL_INFO
+	loggo.Ini(loggo.Config{
+		Level:  level,
+		Prefix: "mosaic",
+		MaxDay: 3,
+	})
+
+	if *export != "" {
+		export_lib(*database, *libname, *export)
+		return
+	}
+	if *importfile != "" {
+		import_lib(*database, *libname, strings.Split(*importfile, ","), *rewrite)
+		return
+	}
+	if *reroot != "" {
+		reroot_lib(*database, *libname, *reroot)
+		return
+	}
+	if *stats {
+		stats_lib(*database, *libname, *neardist)
+		return
+	}
+	if *coverage != "" {
+		if *coveragetop < 1 {
+			loggo.Error("coveragetop %d below 1", *coveragetop)
+			return
+		}
+		var srcimg image.Image
+		if *src != "" {
+			var err error
+			err, srcimg, _ = parse_src(*src, *scalealg, *srcsize, nil)
+			if err != nil {
+				return
+			}
+		}
+		coverage_lib(*database, *libname, *pixelsize, srcimg, *coverage, *coveragetop)
+		return
+	}
+
+	if *src == "" || *target == "" {
+		fmt.Println("need src target")
+		flag.Usage()
+		return
+	}
+	if *thumbformat != "png" && *thumbformat != "jpg" {
+		fmt.Println("thumbformat type error, png/jpg")
+		flag.Usage()
+		return
+	}
+	if *preview != "" && *preview != "tile" && *preview != "flat" {
+		fmt.Println("preview type error, tile/flat")
 		flag.Usage()
 		return
 	}
@@ -57,136 +163,249 @@ func main() {
 		flag.Usage()
 		return
 	}
+	if *topfalloff < 0 {
+		fmt.Println("topfalloff error, 0 or more")
+		flag.Usage()
+		return
+	}
 	if !strings.HasSuffix(strings.ToLower(*target), ".png") &&
-		!strings.HasSuffix(strings.ToLower(*target), ".jpg") {
-		fmt.Println("target type error, png/jpg")
+		!strings.HasSuffix(strings.ToLower(*target), ".jpg") &&
+		!strings.HasSuffix(strings.ToLower(*target), ".tif") &&
+		!strings.HasSuffix(strings.ToLower(*target), ".tiff") &&
+		!strings.HasSuffix(strings.ToLower(*target), ".gif") {
+		fmt.Println("target type error, png/jpg/tif, gif for animated src")
 		flag.Usage()
 		return
 	}
 
-	level := loggo.LEVEL_INFO
-	loggo.Ini(loggo.Config{
-		Level:  level,
-		Prefix: "mosaic",
-		MaxDay: 3,
-	})
+	var layout *PrintLayout
+	if *printwidth > 0 || *printheight > 0 {
+		if *dpi <= 0 {
+			*dpi = 300
+		}
+		pl, err := calc_print_layout(*printwidth, *printheight, *printunit, *dpi, *bleed, *cropmarks, *srcsize)
+		if err != nil {
+			fmt.Println("print size error", err)
+			flag.Usage()
+			return
+		}
+		layout = pl
+		*pixelsize = pl.pixelsize
+	}
+
 	loggo.Info("start...")
 
 	loggo.Info("src %s", *src)
 	loggo.Info("target %s", *target)
 	loggo.Info("lib %s", *lib)
 
-	err, srcimg, cachemap := parse_src(*src, *scalealg, *srcsize)
+	ts, err := parse_transforms(*transform)
+	if err != nil {
+		return
+	}
+
+	// a gif with several frames or a directory of frames renders every frame
+	frames, err := load_frames(*src, *framedelay)
+	if err != nil {
+		return
+	}
+	if frames == nil && strings.HasSuffix(strings.ToLower(*target), ".gif") {
+		loggo.Error("gif target needs an animated src %s", *src)
+		return
+	}
+	var photo image.Image
+	if frames != nil {
+		photo = frames.images[0]
+	} else {
+		err, photo = load_src(*src)
+		if err != nil {
+			return
+		}
+	}
+	err, srcimg, detail := scale_src(photo, *scalealg, *srcsize, layout)
+	if err != nil {
+		return
+	}
+	if !ts.best {
+		detail = nil
+	}
+	libnames, libweights, err := parse_libs(*libs)
+	if err != nil {
+		return
+	}
+	if len(libnames) == 0 {
+		libnames = []string{*libname}
+		libweights = []float64{1}
+	}
+	if *libmode != "weight" && *libmode != "priority" {
+		loggo.Error("unknown libmode %s, use weight/priority", *libmode)
+		return
+	}
+	masklibs, err := parse_masklib(*masklib)
+	if err != nil {
+		return
+	}
+	if len(masklibs) > 0 && *mask == "" && *maskrect == "" && *maskpoly == "" {
+		loggo.Error("masklib needs a mask")
+		return
+	}
+
+	if *alpha != "skip" && *alpha != "fade" && *alpha != "off" {
+		loggo.Error("unknown alpha %s, use skip/fade/off", *alpha)
+		return
+	}
+
+	mono, err := new_tone(*tone, *duotone)
+	if err != nil {
+		return
+	}
+
+	cellsize := *pixelsize
+	if *preview != "" {
+		cellsize = preview_size
+	}
+	style, err := new_tile_style(cellsize, *grout, *groutcolor, *corner, *shadow)
 	if err != nil {
 		return
 	}
-	err = load_lib(*lib, *worker, *database, *pixelsize, *scalealg, *checkhash, *libname)
+
+	build, err := new_build_up(*buildup, *buildorder, *buildzoom, *buildfocus, *buildframes, *buildwidth, *builddelay)
 	if err != nil {
 		return
 	}
-	err = gen_target(srcimg, *target, *worker, *database, *pixelsize, *maxsize, *scalealg, *libname, cachemap)
+	if build != nil && frames != nil {
+		loggo.Error("buildup needs a single picture src")
+		return
+	}
+
+	var m *Mask
+	if *mask != "" || *maskrect != "" || *maskpoly != "" {
+		m, err = load_mask(photo, *mask, *maskrect, *maskpoly, *maskinvert, layout, srcimg.Bounds().Dx(), srcimg.Bounds().Dy())
+		if err != nil {
+			return
+		}
+	}
+	if *lib != "" {
+		err = load_lib(*lib, *worker, *database, *pixelsize, *scalealg, *checkhash, *libname, *thumbformat)
+		if err != nil {
+			return
+		}
+	} else {
+		loggo.Info("no lib, use database only %s %s", *database, *libname)
+	}
+	if frames != nil {
+		anim := new_anim(*target, frames, *coherence, *dpi, *tiffcompress, *bigtiff, *worker)
+		for i, frame := range frames.images {
+			loggo.Info("frame %d/%d", i+1, len(frames.images))
+			if i > 0 {
+				err, srcimg, detail = scale_src(frame, *scalealg, *srcsize, layout)
+				if err != nil {
+					return
+				}
+				if !ts.best {
+					detail = nil
+				}
+				if m != nil {
+					m.photo = frame
+				}
+			}
+			err = gen_target(srcimg, *target, *worker, *database, *pixelsize, *maxsize, *scalealg, libnames, libweights, *libmode == "priority", *libthreshold, masklibs,
+				layout, *dpi, *tiffcompress, *bigtiff,
+				*maxreuse, *neighbor, *neardist, *report, *preview, *job, *resume, *cachemem,
+				new_top_select(*topk, *topdist, *topfalloff), ts, detail, m, style, *alpha, mono, anim, nil)
+			if err != nil {
+				return
+			}
+		}
+		err = anim.write()
+		if err != nil {
+			os.Exit(1)
+		}
+		err = finish_jobs(*database, anim.jobs)
+		if err != nil {
+			loggo.Error("finish frame jobs fail %s %s", *database, err)
+		}
+		return
+	}
+	err = gen_target(srcimg, *target, *worker, *database, *pixelsize, *maxsize, *scalealg, libnames, libweights, *libmode == "priority", *libthreshold, masklibs,
+		layout, *dpi, *tiffcompress, *bigtiff,
+		*maxreuse, *neighbor, *neardist, *report, *preview, *job, *resume, *cachemem,
+		new_top_select(*topk, *topdist, *topfalloff), ts, detail, m, style, *alpha, mono, nil, build)
 	if err != nil {
 		return
 	}
 }
 
-type CacheInfo struct {
-	num  int
-	img  []image.Image
-	lock sync.Mutex
+// parse_src scales the source to one pixel per cell, detail is the same with
+// 2x2 pixels per cell for the sub-tile signatures.
+func parse_src(src string, scalealg string, srcsize int, layout *PrintLayout) (error, image.Image, image.Image) {
+	err, img := load_src(src)
+	if err != nil {
+		return err, nil, nil
+	}
+	return scale_src(img, scalealg, srcsize, layout)
 }
 
-func parse_src(src string, scalealg string, srcsize int) (error, image.Image, *sync.Map) {
+// load_src decodes the source upright.
+func load_src(src string) (error, image.Image) {
 	loggo.Info("parse_src %s", src)
 
 	reader, err := os.Open(src)
 	if err != nil {
 		loggo.Error("parse_src Open fail %s %s", src, err)
-		return err, nil, nil
+		return err, nil
 	}
 	defer reader.Close()
 
 	fi, err := reader.Stat()
 	if err != nil {
 		loggo.Error("parse_src Stat fail %s %s", src, err)
-		return err, nil, nil
+		return err, nil
 	}
 	filesize := fi.Size()
 
 	img, _, err := image.Decode(reader)
 	if err != nil {
 		loggo.Error("parse_src Decode image fail %s %s", src, err)
-		return err, nil, nil
+		return err, nil
 	}
+	img = apply_orientation(img, read_orientation(src))
+
+	loggo.Info("parse_src load ok %s %d %d*%d", src, filesize, img.Bounds().Dx(), img.Bounds().Dy())
+	return nil, img
+}
 
+func scale_src(img image.Image, scalealg string, srcsize int, layout *PrintLayout) (error, image.Image, image.Image) {
 	scale := getScaler(scalealg)
 
 	lenx := img.Bounds().Dx()
 	leny := img.Bounds().Dy()
 	len := common.MaxOfInt(lenx, leny)
-	if len > srcsize {
-		newlenx := lenx * srcsize / len
-		newleny := leny * srcsize / len
-		rect := image.Rectangle{image.Point{0, 0}, image.Point{newlenx, newleny}}
+	var detail image.Image
+	if layout != nil {
+		detail = fit_src(img, scale, layout.gridx*2, layout.gridy*2)
+		img = fit_src(img, scale, layout.gridx, layout.gridy)
+	} else {
+		newlenx := lenx
+		newleny := leny
+		if len > srcsize {
+			newlenx = lenx * srcsize / len
+			newleny = leny * srcsize / len
+		}
+		rect := image.Rectangle{image.Point{0, 0}, image.Point{newlenx * 2, newleny * 2}}
 		dst := image.NewRGBA(rect)
 		scale.Scale(dst, rect, img, img.Bounds(), draw.Over, nil)
-		img = dst
-	}
-
-	bounds := img.Bounds()
-
-	startx := bounds.Min.X
-	starty := bounds.Min.Y
-	endx := bounds.Max.X
-	endy := bounds.Max.Y
-
-	pixelnum := make(map[string]int)
-	for y := starty; y < endy; y++ {
-		for x := startx; x < endx; x++ {
-			r, g, b, _ := img.At(x, y).RGBA()
-			r, g, b = r>>8, g>>8, b>>8
-
-			pixelnum[make_string(uint8(r), uint8(g), uint8(b))]++
-		}
-	}
-
-	var cachemap sync.Map
-	top := 0
-	num := 0
-	for {
-		maxpixel := ""
-		maxpixelnum := 0
-		for k, v := range pixelnum {
-			if v > maxpixelnum {
-				maxpixelnum = v
-				maxpixel = k
-			}
-		}
-		if maxpixelnum >= 16 {
-			cachemap.Store(maxpixel, &CacheInfo{num: maxpixelnum})
-			num++
-		} else {
-			break
+		detail = dst
+		if len > srcsize {
+			rect = image.Rectangle{image.Point{0, 0}, image.Point{newlenx, newleny}}
+			dst = image.NewRGBA(rect)
+			scale.Scale(dst, rect, img, img.Bounds(), draw.Over, nil)
+			img = dst
 		}
-		if maxpixelnum > top {
-			top = maxpixelnum
-		}
-		pixelnum[maxpixel] = 0
-	}
-
-	loggo.Info("parse_src cache top pixel num=%d max=%d", num, top)
-	for i := 2; i <= top; i++ {
-		cachemap.Range(func(key, value interface{}) bool {
-			ci := value.(*CacheInfo)
-			if ci.num == i {
-				loggo.Info("parse_src cache top pixel [%s]=%d", key, i)
-			}
-			return true
-		})
 	}
 
-	loggo.Info("parse_src ok %s %d %d*%d", src, filesize, img.Bounds().Dx(), img.Bounds().Dy())
-	return nil, img, &cachemap
+	loggo.Info("parse_src ok %d*%d", img.Bounds().Dx(), img.Bounds().Dy())
+	return nil, img, detail
 }
 
 func getScaler(scalealg string) draw.Scaler {
@@ -203,18 +422,36 @@ func getScaler(scalealg string) draw.Scaler {
 	return scale
 }
 
+// FileInfo is stored once per content in a library and shared by all pixel
+// sizes, Paths lists every copy of the content.
 type FileInfo struct {
-	Filename string
-	R        uint8
-	G        uint8
-	B        uint8
-	Hash     string
+	Hash        string
+	Paths       []string
+	Orientation int
+	Crop        image.Rectangle
+	DHash       uint64
+	HasDHash    bool
+}
+
+// TileInfo is the data derived from a file for one pixel size.
+type TileInfo struct {
+	R uint8
+	G uint8
+	B uint8
 }
 
 type CalFileInfo struct {
-	fi   FileInfo
-	ok   bool
-	done bool
+	fi      FileInfo
+	path    string
+	ti      TileInfo
+	thumb   []byte
+	preview []byte
+	// the thumb of a bigger pixel size the data is scaled from, without the file
+	from    []byte
+	indexed bool
+	dup     bool
+	ok      bool
+	done    bool
 }
 
 type ColorData struct {
@@ -224,7 +461,7 @@ type ColorData struct {
 	b    uint8
 }
 
-func load_lib(lib string, workernum int, database string, pixelsize int, scalealg string, checkhash bool, libname string) error {
+func load_lib(lib string, workernum int, database string, pixelsize int, scalealg string, checkhash bool, libname string, thumbformat string) error {
 	loggo.Info("load_lib %s", lib)
 
 	loggo.Info("load_lib start ini database")
@@ -250,29 +487,72 @@ func load_lib(lib string, workernum int, database string, pixelsize int, scaleal
 
 	loggo.Info("load_lib start load database")
 
-	db, err := bolt.Open(database, 0600, nil)
+	db, err := open_database(database)
 	if err != nil {
 		loggo.Error("load_lib Open database fail %s %s", database, err)
 		return err
 	}
 	defer db.Close()
 
-	bucket_name := "FileInfo" + libname + strconv.Itoa(pixelsize)
+	bucket_name := make_lib_bucket(libname)
+	path_bucket_name := make_path_bucket(libname)
+	tile_bucket_name := make_tile_bucket(libname, pixelsize)
+	thumb_bucket_name := make_thumb_bucket(libname, pixelsize)
+	preview_bucket_name := make_preview_bucket(libname)
+
+	// files are stored relative to the lib root, so the lib can be moved
+	walkroot, err := filepath.Abs(lib)
+	if err != nil {
+		loggo.Error("load_lib get Abs fail %s %s %s", database, lib, err)
+		return err
+	}
+	root := walkroot
 
 	dbtotal := 0
-	db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(bucket_name))
-		if err != nil {
-			loggo.Error("load_lib Open database CreateBucketIfNotExists fail %s %s %s", database, bucket_name, err)
-			os.Exit(1)
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{bucket_name, path_bucket_name, tile_bucket_name, thumb_bucket_name, preview_bucket_name} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				loggo.Error("load_lib Open database CreateBucketIfNotExists fail %s %s %s", database, name, err)
+				os.Exit(1)
+			}
+		}
+		// a part of the lib keeps the root, a parent directory becomes the root
+		// with the files rekeyed, anything else is a moved lib for -reroot
+		oldroot := get_lib_root(tx, libname)
+		if oldroot != "" && oldroot != root {
+			if _, ok := path_within(oldroot, root); ok {
+				loggo.Info("load_lib %s is under the lib root %s %s", root, libname, oldroot)
+				root = oldroot
+			} else if rel, ok := path_within(root, oldroot); ok {
+				loggo.Info("load_lib lib root change %s %s -> %s", libname, oldroot, root)
+				err := rekey_lib_paths(tx, libname, filepath.ToSlash(rel))
+				if err != nil {
+					loggo.Error("load_lib rekey lib fail %s %s %s", database, root, err)
+					return err
+				}
+			} else {
+				loggo.Error("load_lib lib root of %s is %s, not %s, use -reroot if the lib was moved", libname, oldroot, root)
+				return errors.New("lib root differs")
+			}
+		}
+		if oldroot != root {
+			err := set_lib_root(tx, libname, root)
+			if err != nil {
+				loggo.Error("load_lib set lib root fail %s %s %s", database, root, err)
+				return err
+			}
 		}
-		b := tx.Bucket([]byte(bucket_name))
+		b := tx.Bucket([]byte(path_bucket_name))
 		b.ForEach(func(k, v []byte) error {
 			dbtotal++
 			return nil
 		})
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 
 	lastload := time.Now()
 	beginload := time.Now()
@@ -281,7 +561,7 @@ func load_lib(lib string, workernum int, database string, pixelsize int, scaleal
 	var doneloadsize int64
 	var lock sync.Mutex
 	db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucket_name))
+		b := tx.Bucket([]byte(path_bucket_name))
 
 		need_del := make([]string, 0)
 
@@ -295,23 +575,14 @@ func load_lib(lib string, workernum int, database string, pixelsize int, scaleal
 
 			lf := in.(LoadFileInfo)
 
-			var b bytes.Buffer
-			b.Write(lf.v)
-
-			dec := gob.NewDecoder(&b)
-			var fi FileInfo
-			err = dec.Decode(&fi)
-			if err != nil {
-				loggo.Error("load_lib Open database Decode fail %s %s %s", database, string(lf.k), err)
-				lock.Lock()
-				defer lock.Unlock()
-				need_del = append(need_del, string(lf.k))
+			path := resolve_path(root, string(lf.k))
+			// only the files of the tree walked can be found missing
+			if _, ok := path_within(walkroot, path); !ok {
 				return
 			}
-
-			osfi, err := os.Stat(fi.Filename)
+			osfi, err := os.Stat(path)
 			if err != nil && os.IsNotExist(err) {
-				loggo.Error("load_lib Open Filename IsNotExist, need delete %s %s %s", database, fi.Filename, err)
+				loggo.Error("load_lib Open Filename IsNotExist, need delete %s %s %s", database, path, err)
 				lock.Lock()
 				defer lock.Unlock()
 				need_del = append(need_del, string(lf.k))
@@ -321,23 +592,23 @@ func load_lib(lib string, workernum int, database string, pixelsize int, scaleal
 			defer atomic.AddInt64(&doneloadsize, osfi.Size())
 
 			if checkhash {
-				reader, err := os.Open(fi.Filename)
+				reader, err := os.Open(path)
 				if err != nil {
-					loggo.Error("load_lib Open fail %s %s %s", database, fi.Filename, err)
+					loggo.Error("load_lib Open fail %s %s %s", database, path, err)
 					return
 				}
 				defer reader.Close()
 
 				bytes, err := ioutil.ReadAll(reader)
 				if err != nil {
-					loggo.Error("load_lib ReadAll fail %s %s %s", database, fi.Filename, err)
+					loggo.Error("load_lib ReadAll fail %s %s %s", database, path, err)
 					return
 				}
 
 				hashstr := common.GetXXHashString(string(bytes))
 
-				if hashstr != fi.Hash {
-					loggo.Error("load_lib hash diff need delete %s %s %s %s", database, fi.Filename, hashstr, fi.Hash)
+				if hashstr != string(lf.v) {
+					loggo.Error("load_lib hash diff need delete %s %s %s %s", database, path, hashstr, string(lf.v))
 					lock.Lock()
 					defer lock.Unlock()
 					need_del = append(need_del, string(lf.k))
@@ -379,7 +650,10 @@ func load_lib(lib string, workernum int, database string, pixelsize int, scaleal
 		tp.Stop()
 
 		for _, k := range need_del {
-			b.Delete([]byte(k))
+			err := remove_lib_path(tx, libname, k)
+			if err != nil {
+				loggo.Error("load_lib remove_lib_path fail %s %s %s", database, k, err)
+			}
 		}
 
 		return nil
@@ -390,40 +664,130 @@ func load_lib(lib string, workernum int, database string, pixelsize int, scaleal
 	loggo.Info("load_lib start get image file list")
 	imagefilelist := make([]CalFileInfo, 0)
 	cached := 0
+	// contents queued in this run, a copy found later is only added to the paths
+	var claimed sync.Map
+	claim := func(hash string) bool {
+		if _, loaded := claimed.LoadOrStore(hash, true); loaded {
+			return false
+		}
+		has := false
+		db.View(func(tx *bolt.Tx) error {
+			has = tx.Bucket([]byte(tile_bucket_name)).Get([]byte(hash)) != nil && tx.Bucket([]byte(thumb_bucket_name)).Get([]byte(hash)) != nil &&
+				tx.Bucket([]byte(preview_bucket_name)).Get([]byte(hash)) != nil
+			return nil
+		})
+		return !has
+	}
+	// thumbs of bigger pixel sizes, smallest first, a known content is scaled
+	// down from one instead of decoding the file
+	var fromsizes []int
+	db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if ps, err := strconv.Atoi(strings.TrimPrefix(string(name), "Thumb:"+libname+":")); err == nil && ps > pixelsize {
+				fromsizes = append(fromsizes, ps)
+			}
+			return nil
+		})
+	})
+	sort.Ints(fromsizes)
+	fromnum := 0
+
+	formatnum := make(map[string]int)
+	skipnum := make(map[string]int)
 	filepath.Walk(lib, func(path string, f os.FileInfo, err error) error {
 
 		if f == nil || f.IsDir() {
 			return nil
 		}
 
-		if !strings.HasSuffix(strings.ToLower(f.Name()), ".jpeg") &&
-			!strings.HasSuffix(strings.ToLower(f.Name()), ".jpg") &&
-			!strings.HasSuffix(strings.ToLower(f.Name()), ".png") &&
-			!strings.HasSuffix(strings.ToLower(f.Name()), ".gif") {
-			return nil
-		}
-
 		abspath, err := filepath.Abs(path)
 		if err != nil {
 			loggo.Error("load_lib get Abs fail %s %s %s", database, path, err)
 			return nil
 		}
+		rel, err := filepath.Rel(root, abspath)
+		if err != nil {
+			loggo.Error("load_lib get Rel fail %s %s %s", database, abspath, err)
+			return nil
+		}
+		key := filepath.ToSlash(rel)
 
+		var hash []byte
+		var indexed []byte
+		incache := false
 		db.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(bucket_name))
-			v := b.Get([]byte(abspath))
-			if v == nil {
-				imagefilelist = append(imagefilelist, CalFileInfo{fi: FileInfo{abspath, 0, 0, 0, ""}})
-			} else {
-				cached++
+			h := tx.Bucket([]byte(path_bucket_name)).Get([]byte(key))
+			if h != nil {
+				hash = append([]byte(nil), h...)
+				incache = tx.Bucket([]byte(tile_bucket_name)).Get(h) != nil && tx.Bucket([]byte(thumb_bucket_name)).Get(h) != nil &&
+					tx.Bucket([]byte(preview_bucket_name)).Get(h) != nil
+				v := tx.Bucket([]byte(bucket_name)).Get(h)
+				if v != nil {
+					indexed = append([]byte(nil), v...)
+				}
 			}
 			return nil
 		})
+		var fi FileInfo
+		known := false
+		if indexed != nil {
+			fi, err = decode_file_info(indexed)
+			known = err == nil
+		}
+		// contents indexed before the dhash, thumb and preview were stored are calculated once more
+		if incache && (!known || fi.HasDHash) {
+			cached++
+			return nil
+		}
+
+		// known content, only the data of this pixel size is missing
+		if known {
+			if _, ok := claimed.Load(string(hash)); ok {
+				cached++
+				return nil
+			}
+			if !fi.Crop.Empty() {
+				claimed.Store(string(hash), true)
+				var from []byte
+				// the dhash is calculated from the file
+				db.View(func(tx *bolt.Tx) error {
+					if !fi.HasDHash {
+						return nil
+					}
+					for _, ps := range fromsizes {
+						if v := tx.Bucket([]byte(make_thumb_bucket(libname, ps))).Get(hash); v != nil {
+							from = append([]byte(nil), v...)
+							fromnum++
+							return nil
+						}
+					}
+					return nil
+				})
+				imagefilelist = append(imagefilelist, CalFileInfo{fi: fi, path: abspath, from: from, indexed: true})
+				return nil
+			}
+		}
+
+		format, err := sniff_image(abspath)
+		if err != nil {
+			ext := strings.ToLower(filepath.Ext(f.Name()))
+			if ext == "" {
+				ext = "(none)"
+			}
+			skipnum[ext]++
+			return nil
+		}
+		formatnum[format]++
+
+		imagefilelist = append(imagefilelist, CalFileInfo{fi: FileInfo{Paths: []string{key}}, path: abspath})
 
 		return nil
 	})
 
-	loggo.Info("load_lib get image file list ok %d cache %d", len(imagefilelist), cached)
+	loggo.Info("load_lib get image file list ok %d cache %d from thumb %d", len(imagefilelist), cached, fromnum)
+	for format, num := range formatnum {
+		loggo.Info("load_lib image file format %s = %d", format, num)
+	}
 
 	loggo.Info("load_lib start calc image avg color %d", len(imagefilelist))
 	var worker int32
@@ -434,13 +798,13 @@ func load_lib(lib string, workernum int, database string, pixelsize int, scaleal
 
 	atomic.AddInt32(&worker, 1)
 	var save_inter int
-	go save_to_database(&worker, &imagefilelist, db, &save_inter, bucket_name)
+	go save_to_database(&worker, &imagefilelist, db, &save_inter, bucket_name, path_bucket_name, tile_bucket_name, thumb_bucket_name, preview_bucket_name)
 
 	scale := getScaler(scalealg)
 
 	tp := threadpool.NewThreadPool(workernum, 16, func(in interface{}) {
 		i := in.(int)
-		calc_avg_color(&imagefilelist[i], &worker, &done, &donesize, scale, pixelsize)
+		calc_avg_color(&imagefilelist[i], &worker, &done, &donesize, scale, pixelsize, thumbformat, claim)
 	})
 
 	i := 0
@@ -471,27 +835,39 @@ func load_lib(lib string, workernum int, database string, pixelsize int, scaleal
 
 	loggo.Info("load_lib calc image avg color ok %d %d", len(imagefilelist), done)
 
+	failnum := 0
+	dupnum := 0
+	for _, cfi := range imagefilelist {
+		if !cfi.ok {
+			failnum++
+		} else if cfi.dup {
+			dupnum++
+		}
+	}
+	skiptotal := 0
+	for ext, num := range skipnum {
+		loggo.Info("load_lib skip unsupported file %s = %d", ext, num)
+		skiptotal += num
+	}
+	loggo.Info("load_lib skip summary unsupported %d decode fail %d", skiptotal, failnum)
+	loggo.Info("load_lib duplicate content %d", dupnum)
+
 	loggo.Info("load_lib start save image avg color")
 
 	maxcolornum := 0
 	totalnum := 0
 	db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucket_name))
+		b := tx.Bucket([]byte(tile_bucket_name))
 
 		b.ForEach(func(k, v []byte) error {
 
-			var b bytes.Buffer
-			b.Write(v)
-
-			dec := gob.NewDecoder(&b)
-			var fi FileInfo
-			err = dec.Decode(&fi)
+			ti, err := decode_tile_info(v)
 			if err != nil {
 				loggo.Error("load_lib Open database Decode fail %s %s %s", database, string(k), err)
 				return nil
 			}
 
-			key := make_key(fi.R, fi.G, fi.B)
+			key := make_key(ti.R, ti.G, ti.B)
 			colordata[key].file++
 			if colordata[key].file > maxcolornum {
 				maxcolornum = colordata[key].file
@@ -577,6 +953,21 @@ func load_lib(lib string, workernum int, database string, pixelsize int, scaleal
 	return nil
 }
 
+// sniff_image detects the image format from the file content, the name suffix is not trusted.
+func sniff_image(filename string) (string, error) {
+	reader, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	_, format, err := image.DecodeConfig(reader)
+	if err != nil {
+		return "", err
+	}
+	return format, nil
+}
+
 func make_key(r uint8, g uint8, b uint8) int {
 	return int(r)*256*256 + int(g)*256 + int(b)
 }
@@ -585,19 +976,43 @@ func make_string(r uint8, g uint8, b uint8) string {
 	return "r " + strconv.Itoa(int(r)) + " g " + strconv.Itoa(int(g)) + " b " + strconv.Itoa(int(b))
 }
 
-func calc_img(src image.Image, filename string, scaler draw.Scaler, pixelsize int) (image.Image, error) {
-
-	bounds := src.Bounds()
-
+// calc_crop returns the center square of bounds used as the tile.
+func calc_crop(bounds image.Rectangle) image.Rectangle {
 	len := common.MinOfInt(bounds.Dx(), bounds.Dy())
 	startx := bounds.Min.X + (bounds.Dx()-len)/2
 	starty := bounds.Min.Y + (bounds.Dy()-len)/2
 	endx := common.MinOfInt(startx+len, bounds.Max.X)
 	endy := common.MinOfInt(starty+len, bounds.Max.Y)
+	return image.Rectangle{image.Point{startx, starty}, image.Point{endx, endy}}
+}
 
-	if startx != bounds.Min.X || starty != bounds.Min.Y || endx != bounds.Max.X || endy != bounds.Max.Y {
-		dst := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{len, len}})
-		draw.Copy(dst, image.Point{0, 0}, src, image.Rectangle{image.Point{startx, starty}, image.Point{endx, endy}}, draw.Over, nil)
+// calc_file_crop reads only the image header, empty when the file can not be read.
+func calc_file_crop(filename string, orientation int) image.Rectangle {
+	reader, err := os.Open(filename)
+	if err != nil {
+		return image.Rectangle{}
+	}
+	defer reader.Close()
+
+	cfg, _, err := image.DecodeConfig(reader)
+	if err != nil {
+		return image.Rectangle{}
+	}
+
+	w, h := cfg.Width, cfg.Height
+	if orientation >= 5 {
+		w, h = h, w
+	}
+	return calc_crop(image.Rect(0, 0, w, h))
+}
+
+func calc_img(src image.Image, filename string, crop image.Rectangle, scaler draw.Scaler, pixelsize int) (image.Image, error) {
+
+	bounds := src.Bounds()
+
+	if crop != bounds {
+		dst := image.NewRGBA(image.Rectangle{image.Point{0, 0}, crop.Size()})
+		draw.Copy(dst, image.Point{0, 0}, src, crop, draw.Over, nil)
 		src = dst
 	}
 
@@ -607,7 +1022,7 @@ func calc_img(src image.Image, filename string, scaler draw.Scaler, pixelsize in
 		return nil, errors.New("bounds error")
 	}
 
-	len = common.MinOfInt(bounds.Dx(), bounds.Dy())
+	len := common.MinOfInt(bounds.Dx(), bounds.Dy())
 	if len < pixelsize {
 		loggo.Error("calc_img image too small %s %d %d", filename, len, pixelsize)
 		return nil, errors.New("too small")
@@ -623,7 +1038,22 @@ func calc_img(src image.Image, filename string, scaler draw.Scaler, pixelsize in
 	return src, nil
 }
 
-func calc_avg_color(cfi *CalFileInfo, worker *int32, done *int32, donesize *int64, scaler draw.Scaler, pixelsize int) {
+func encode_thumb(img image.Image, thumbformat string) ([]byte, error) {
+	var b bytes.Buffer
+	var err error
+	if thumbformat == "png" {
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		err = enc.Encode(&b, img)
+	} else {
+		err = jpeg.Encode(&b, img, &jpeg.Options{Quality: 95})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func calc_avg_color(cfi *CalFileInfo, worker *int32, done *int32, donesize *int64, scaler draw.Scaler, pixelsize int, thumbformat string, claim func(hash string) bool) {
 	defer common.CrashLog()
 	defer atomic.AddInt32(worker, -1)
 	defer atomic.AddInt32(done, 1)
@@ -631,30 +1061,78 @@ func calc_avg_color(cfi *CalFileInfo, worker *int32, done *int32, donesize *int6
 		cfi.done = true
 	}()
 
-	reader, err := os.Open(cfi.fi.Filename)
+	if cfi.from != nil {
+		from, _, err := image.Decode(bytes.NewReader(cfi.from))
+		cfi.from = nil
+		if err == nil {
+			rect := image.Rect(0, 0, pixelsize, pixelsize)
+			img := image.NewRGBA(rect)
+			scaler.Scale(img, rect, from, from.Bounds(), draw.Over, nil)
+			calc_tile_data(cfi, img, scaler, thumbformat)
+			return
+		}
+		loggo.Error("calc_avg_color Decode thumb fail, use the file %s %s", cfi.path, err)
+	}
+
+	data, err := ioutil.ReadFile(cfi.path)
 	if err != nil {
-		loggo.Error("calc_avg_color Open fail %s %s", cfi.fi.Filename, err)
+		loggo.Error("calc_avg_color ReadFile fail %s %s", cfi.path, err)
 		return
 	}
-	defer reader.Close()
+	defer atomic.AddInt64(donesize, int64(len(data)))
+
+	// the hash of an indexed file was already checked by load_lib
+	if !cfi.indexed {
+		cfi.fi.Hash = common.GetXXHashString(string(data))
+		if !claim(cfi.fi.Hash) {
+			// a copy of content already indexed, nothing to calc
+			cfi.dup = true
+			cfi.ok = true
+			return
+		}
+		cfi.fi.Orientation = exif_orientation(bytes.NewReader(data))
+	}
 
-	fi, err := reader.Stat()
+	img, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		loggo.Error("calc_avg_color Stat fail %s %s", cfi.fi.Filename, err)
+		loggo.Error("calc_avg_color Decode image fail %s %s", cfi.path, err)
 		return
 	}
-	filesize := fi.Size()
-	defer atomic.AddInt64(donesize, filesize)
 
-	img, _, err := image.Decode(reader)
+	img = apply_orientation(img, cfi.fi.Orientation)
+
+	if cfi.fi.Crop.Empty() {
+		cfi.fi.Crop = calc_crop(img.Bounds())
+	}
+
+	if !cfi.fi.HasDHash {
+		cfi.fi.DHash = calc_crop_dhash(img, cfi.fi.Crop)
+		cfi.fi.HasDHash = true
+	}
+
+	img, err = calc_img(img, cfi.path, cfi.fi.Crop, scaler, pixelsize)
+	if err != nil {
+		loggo.Error("calc_avg_color calc_img image fail %s %s", cfi.path, err)
+		return
+	}
+
+	calc_tile_data(cfi, img, scaler, thumbformat)
+}
+
+// calc_tile_data fills the data of one pixel size from the tile scaled to it.
+func calc_tile_data(cfi *CalFileInfo, img image.Image, scaler draw.Scaler, thumbformat string) {
+	thumb, err := encode_thumb(img, thumbformat)
 	if err != nil {
-		loggo.Error("calc_avg_color Decode image fail %s %s", cfi.fi.Filename, err)
+		loggo.Error("calc_avg_color encode_thumb fail %s %s", cfi.path, err)
 		return
 	}
 
-	img, err = calc_img(img, cfi.fi.Filename, scaler, pixelsize)
+	rect := image.Rect(0, 0, preview_size, preview_size)
+	previewimg := image.NewRGBA(rect)
+	scaler.Scale(previewimg, rect, img, img.Bounds(), draw.Over, nil)
+	preview, err := encode_thumb(previewimg, thumbformat)
 	if err != nil {
-		loggo.Error("calc_avg_color calc_img image fail %s %s", cfi.fi.Filename, err)
+		loggo.Error("calc_avg_color encode_thumb preview fail %s %s", cfi.path, err)
 		return
 	}
 
@@ -675,29 +1153,27 @@ func calc_avg_color(cfi *CalFileInfo, worker *int32, done *int32, donesize *int6
 		}
 	}
 
-	readerhash, err := os.Open(cfi.fi.Filename)
-	if err != nil {
-		loggo.Error("calc_avg_color Open fail %s %s", cfi.fi.Filename, err)
-		return
-	}
-	defer readerhash.Close()
-
-	b, err := ioutil.ReadAll(readerhash)
-	if err != nil {
-		loggo.Error("calc_avg_color ReadAll fail %s %d", cfi.fi.Filename, pixelsize)
-		return
-	}
-
-	cfi.fi.R = uint8(sumR / count)
-	cfi.fi.G = uint8(sumG / count)
-	cfi.fi.B = uint8(sumB / count)
-	cfi.fi.Hash = common.GetXXHashString(string(b))
+	cfi.ti.R = uint8(sumR / count)
+	cfi.ti.G = uint8(sumG / count)
+	cfi.ti.B = uint8(sumB / count)
+	cfi.thumb = thumb
+	cfi.preview = preview
 	cfi.ok = true
 
 	return
 }
 
-func save_to_database(worker *int32, imagefilelist *[]CalFileInfo, db *bolt.DB, save_inter *int, bucket_name string) {
+func has_path(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func save_to_database(worker *int32, imagefilelist *[]CalFileInfo, db *bolt.DB, save_inter *int, bucket_name string, path_bucket_name string, tile_bucket_name string, thumb_bucket_name string,
+	preview_bucket_name string) {
 	defer common.CrashLog()
 	defer atomic.AddInt32(worker, -1)
 
@@ -712,23 +1188,71 @@ func save_to_database(worker *int32, imagefilelist *[]CalFileInfo, db *bolt.DB,
 			i++
 
 			if cfi.ok {
-				var b bytes.Buffer
-
-				enc := gob.NewEncoder(&b)
-				err := enc.Encode(&cfi.fi)
+				tv, err := encode_tile_info(&cfi.ti)
 				if err != nil {
-					loggo.Error("calc_avg_color Encode FileInfo fail %s %s", cfi.fi.Filename, err)
+					loggo.Error("calc_avg_color Encode TileInfo fail %s %s", cfi.path, err)
 					return
 				}
 
-				k := []byte(cfi.fi.Filename)
-				v := b.Bytes()
+				k := []byte(cfi.fi.Hash)
 
-				db.Update(func(tx *bolt.Tx) error {
+				err = db.Update(func(tx *bolt.Tx) error {
 					b := tx.Bucket([]byte(bucket_name))
-					err := b.Put(k, v)
-					return err
+					fi := cfi.fi
+					// copies can finish in any order, keep the paths of all of them
+					if old := b.Get(k); old != nil {
+						ofi, err := decode_file_info(old)
+						if err == nil {
+							for _, p := range fi.Paths {
+								if !has_path(ofi.Paths, p) {
+									ofi.Paths = append(ofi.Paths, p)
+								}
+							}
+							if cfi.dup {
+								fi = ofi
+							} else {
+								fi.Paths = ofi.Paths
+								// the dhash stays the one first calculated
+								if ofi.HasDHash {
+									fi.DHash, fi.HasDHash = ofi.DHash, ofi.HasDHash
+								}
+							}
+						}
+					}
+
+					v, err := encode_file_info(&fi)
+					if err != nil {
+						return err
+					}
+					err = b.Put(k, v)
+					if err != nil {
+						return err
+					}
+					for _, p := range cfi.fi.Paths {
+						err = tx.Bucket([]byte(path_bucket_name)).Put([]byte(p), k)
+						if err != nil {
+							return err
+						}
+					}
+					if cfi.dup {
+						return nil
+					}
+					err = tx.Bucket([]byte(tile_bucket_name)).Put(k, tv)
+					if err != nil {
+						return err
+					}
+					err = tx.Bucket([]byte(thumb_bucket_name)).Put(k, cfi.thumb)
+					if err != nil {
+						return err
+					}
+					return tx.Bucket([]byte(preview_bucket_name)).Put(k, cfi.preview)
 				})
+				if err != nil {
+					loggo.Error("calc_avg_color save fail %s %s", cfi.path, err)
+				}
+				// the thumb is in database now, no need to keep it in memory
+				(*imagefilelist)[i-1].thumb = nil
+				(*imagefilelist)[i-1].preview = nil
 			}
 
 			*save_inter = i
@@ -738,18 +1262,19 @@ func save_to_database(worker *int32, imagefilelist *[]CalFileInfo, db *bolt.DB,
 	}
 }
 
-func gen_target(srcimg image.Image, target string, workernum int, database string, pixelsize int, maxsize int, scalealg string, libname string, cachemap *sync.Map) error {
+func gen_target(srcimg image.Image, target string, workernum int, database string, pixelsize int, maxsize int, scalealg string,
+	libnames []string, libweights []float64, priority bool, threshold float64, masklibs map[color.RGBA]string, layout *PrintLayout, dpi int, tiffcompress bool, bigtiff bool, maxreuse int, neighbor int, neardist int, report string, preview string,
+	job string, resume bool, cachemem int, top *TopSelect,
+	ts *TransformSet, detail image.Image, mask *Mask, style *TileStyle, alpha string, tone *Tone, anim *Anim, build *BuildUp) error {
 	loggo.Info("gen_target %s", target)
 
-	db, err := bolt.Open(database, 0600, nil)
+	db, err := open_database(database)
 	if err != nil {
 		loggo.Error("gen_target Open database fail %s %s", database, err)
 		return err
 	}
 	defer db.Close()
 
-	bucket_name := "FileInfo" + libname + strconv.Itoa(pixelsize)
-
 	bounds := srcimg.Bounds()
 
 	startx := bounds.Min.X
@@ -762,10 +1287,34 @@ func gen_target(srcimg image.Image, target string, workernum int, database strin
 	total := bounds.Dx() * bounds.Dy()
 	var done int32
 	var doing int32
-	var cached int32
 
-	lenx := bounds.Dx() * pixelsize
-	leny := bounds.Dy() * pixelsize
+	// the decoded tiles recently drawn
+	tc := new_tile_cache(int64(cachemem) * 1024 * 1024)
+
+	// tiles are still matched with the pixelsize data, only drawn small
+	cellsize := pixelsize
+	flat := preview == "flat"
+	if preview != "" {
+		loggo.Info("gen_target preview %s cell %d", preview, preview_size)
+		cellsize = preview_size
+		layout = nil
+	}
+
+	ls, err := open_lib_set(db, libnames, libweights, priority, threshold, masklibs, mask, bounds.Dx(), bounds.Dy(), pixelsize, preview, tone)
+	if err != nil {
+		loggo.Error("gen_target open libs fail %s %s", database, err)
+		return err
+	}
+
+	if layout == nil {
+		layout = default_layout(bounds, cellsize, dpi)
+	}
+	if anim != nil {
+		anim.begin(total)
+	}
+
+	lenx := layout.canvasx
+	leny := layout.canvasy
 
 	outputfilesize := lenx * leny * 4 / 1024 / 1024 / 1024
 	if outputfilesize > maxsize {
@@ -775,28 +1324,179 @@ func gen_target(srcimg image.Image, target string, workernum int, database strin
 
 	loggo.Info("gen_target start gen pixel %s %dG max %dG", target, outputfilesize, maxsize)
 
-	dst := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{lenx, leny}})
+	canvas := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{lenx, leny}})
+	if layout.mark > 0 {
+		draw.Draw(canvas, canvas.Bounds(), &image.Uniform{color.RGBA{255, 255, 255, 255}}, image.Point{}, draw.Src)
+	}
+	dst := canvas.SubImage(layout.area()).(*image.RGBA)
+
+	if alpha != "off" {
+		transparent := 0
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				if _, a := src_color(srcimg, startx+x, starty+y); a == 0 && ls.cells[y*bounds.Dx()+x] >= 0 {
+					ls.cells[y*bounds.Dx()+x] = -1
+					transparent++
+				}
+			}
+		}
+		if transparent > 0 {
+			loggo.Info("gen_target alpha %s transparent cells %d", alpha, transparent)
+		}
+	}
+
+	params := job_params(srcimg, target, ls.signature(), pixelsize, cellsize, preview, maxreuse, neighbor, neardist, top, mask, tone, layout)
+	if job == "" {
+		job = common.GetXXHashString(params)
+	}
+	if anim != nil {
+		// every frame a job of its own
+		job = fmt.Sprintf("%s_%04d", job, anim.out.num)
+	}
+	resumed, err := open_job(db, job, params, resume)
+	if err != nil {
+		loggo.Error("gen_target open job fail %s %s", job, err)
+		return err
+	}
+	written := job_written(db, job)
+	loggo.Info("gen_target job %s resume %d/%d cells", job, len(resumed), total)
+	cp := new_checkpoint(db, job)
+
+	// with reuse limits the cells depend on each other, pick all tiles first
+	var assign [][]string
+	if maxreuse > 0 || neighbor > 0 {
+		// cells without a tile are saved as "", the assignment is complete when
+		// every cell of a mix is saved
+		usable := 0
+		saved := 0
+		for i, m := range ls.cells {
+			if m >= 0 {
+				usable++
+				if _, ok := resumed[i]; ok {
+					saved++
+				}
+			}
+		}
+		if usable > 0 && saved == usable {
+			assign = make([][]string, bounds.Dy())
+			for y := range assign {
+				assign[y] = make([]string, bounds.Dx())
+				for x := range assign[y] {
+					assign[y][x] = resumed[y*bounds.Dx()+x]
+				}
+			}
+		} else {
+			loggo.Info("gen_target assign tiles maxreuse %d neighbor %d", maxreuse, neighbor)
+			assign = make([][]string, bounds.Dy())
+			for y := range assign {
+				assign[y] = make([]string, bounds.Dx())
+			}
+			// every mix on its own cells, weights and priority do not apply
+			for m, mix := range ls.mixes {
+				m := m
+				use := func(x int, y int) bool {
+					return ls.cells[y*bounds.Dx()+x] == m
+				}
+				num := 0
+				for _, c := range ls.cells {
+					if c == m {
+						num++
+					}
+				}
+				if num == 0 {
+					continue
+				}
+				cands := load_tile_cands(db, mix.libs, neardist, tone)
+				part := assign_tiles(srcimg, cands, maxreuse, neighbor, use, tone)
+				for y := range part {
+					for x, key := range part[y] {
+						if use(x, y) {
+							assign[y][x] = key
+							cp.pending[y*bounds.Dx()+x] = key
+						}
+					}
+				}
+			}
+			cp.flush()
+		}
+	}
+
+	// cells left out of the mask show the source photo
+	if mask != nil && mask.count() < total {
+		rect := image.Rect(layout.offx, layout.offy, layout.offx+bounds.Dx()*cellsize, layout.offy+bounds.Dy()*cellsize)
+		getScaler(scalealg).Scale(dst, rect, mask.photo, mask.crop, draw.Src, nil)
+		tone.apply(dst, rect)
+	}
+
+	// the tile key of every cell for the quality report
+	chosen := make([][]string, bounds.Dy())
+	for y := range chosen {
+		chosen[y] = make([]string, bounds.Dx())
+	}
 
 	type GenInfo struct {
 		x int
 		y int
 		c color.RGBA
+		a uint8
 	}
 
 	tp := threadpool.NewThreadPool(workernum, 16, func(in interface{}) {
 		defer atomic.AddInt32(&done, 1)
 		defer atomic.AddInt32(&doing, -1)
 		gi := in.(GenInfo)
-		gen_target_pixel(gi.c, gi.x, gi.y, dst, db, bucket_name, pixelsize, scalealg, cachemap, &cached)
+		pos := image.Point{layout.offx + (gi.x-startx)*cellsize, layout.offy + (gi.y-starty)*cellsize}
+		cell := (gi.y-starty)*bounds.Dx() + (gi.x - startx)
+		if ls.cells[cell] < 0 {
+			anim.set(cell, "", gi.c, gi.a)
+			return
+		}
+		// the same tile as the frame before, as it was drawn
+		if anim.keep(cell, gi.c, gi.a) {
+			r := image.Rect(pos.X, pos.Y, pos.X+cellsize, pos.Y+cellsize)
+			draw.Draw(dst, r, anim.prev, r.Min, draw.Src)
+			chosen[gi.y-starty][gi.x-startx] = anim.keys[cell]
+			cp.add(cell, anim.keys[cell])
+			return
+		}
+		defer func() {
+			anim.set(cell, chosen[gi.y-starty][gi.x-startx], gi.c, gi.a)
+		}()
+		if alpha == "fade" && gi.a < 255 {
+			defer fade_cell(dst, image.Rect(pos.X, pos.Y, pos.X+cellsize, pos.Y+cellsize), gi.a)
+		}
+		sig := cell_signature(detail, gi.x-startx, gi.y-starty)
+		for i := range sig {
+			sig[i] = tone.color(sig[i])
+		}
+		// finished by the run before, only draw it again
+		if key, ok := resumed[cell]; ok && assign == nil {
+			if gen_target_tile(key, pos, dst, db, ls.libof[key], cellsize, scalealg, flat, tc, ts, sig, style, gi.c) {
+				chosen[gi.y-starty][gi.x-startx] = key
+				return
+			}
+		}
+		if assign != nil {
+			key := assign[gi.y-starty][gi.x-startx]
+			if gen_target_tile(key, pos, dst, db, ls.libof[key], cellsize, scalealg, flat, tc, ts, sig, style, gi.c) {
+				chosen[gi.y-starty][gi.x-startx] = key
+			}
+			return
+		}
+		key := gen_target_pixel(gi.c, pos, dst, db, ls.mixes[ls.cells[cell]], cellsize, scalealg, flat, top, tc, ts, sig, style)
+		chosen[gi.y-starty][gi.x-startx] = key
+		if key != "" {
+			cp.add(cell, key)
+		}
 	})
 
 	for y := starty; y < endy; y++ {
 		for x := startx; x < endx; x++ {
-			r, g, b, _ := srcimg.At(x, y).RGBA()
-			r, g, b = r>>8, g>>8, b>>8
+			c, a := src_color(srcimg, x, y)
+			c = tone.gray(c)
 
 			for {
-				ret := tp.AddJobTimeout(int(common.RandInt()), GenInfo{x: x, y: y, c: color.RGBA{uint8(r), uint8(g), uint8(b), 0}}, 10)
+				ret := tp.AddJobTimeout(int(common.RandInt()), GenInfo{x: x, y: y, c: c, a: a}, 10)
 				if ret {
 					atomic.AddInt32(&doing, 1)
 					break
@@ -810,8 +1510,8 @@ func gen_target(srcimg image.Image, target string, workernum int, database strin
 				if speed > 0 {
 					left = time.Duration(int64(float64(total-int(done))/speed) * int64(time.Second)).String()
 				}
-				loggo.Info("gen speed=%.2f/s percent=%d%% time=%s thead=%d progress=%d/%d cached=%d cached-percent=%d%%", speed, int(done)*100/total,
-					left, int(doing), int(done), total, cached, int(cached)*100/total)
+				loggo.Info("gen speed=%.2f/s percent=%d%% time=%s thead=%d progress=%d/%d %s", speed, int(done)*100/total,
+					left, int(doing), int(done), total, tc.stats())
 			}
 		}
 	}
@@ -821,143 +1521,222 @@ func gen_target(srcimg image.Image, target string, workernum int, database strin
 	}
 
 	tp.Stop()
+	cp.flush()
 
 	loggo.Info("gen_target gen pixel ok %s", target)
+	loggo.Info("gen_target tile cache %s", tc.stats())
+
+	draw_crop_marks(canvas, layout)
+
+	if anim != nil {
+		// a frame of the animation, written with the others, its job is kept
+		// till the whole animation is written
+		err = anim.add_frame(canvas, written)
+		if err == nil {
+			err = write_job(db, job)
+			anim.jobs = append(anim.jobs, job)
+		}
+	} else {
+		qr := calc_quality(target, srcimg, chosen, dst, layout, cellsize, db, ls.libof, tone, ls.cells)
+		if report == "" {
+			report = strings.TrimSuffix(target, filepath.Ext(target)) + ".json"
+		} else if report == "none" {
+			report = ""
+		}
+		write_quality(qr, report)
+
+		loggo.Info("gen_target start write file %s", target)
+		err = write_target(canvas, target, layout.dpi, tiffcompress, bigtiff, workernum)
+	}
+	if err != nil {
+		return err
+	}
+	if anim == nil {
+		loggo.Info("gen_target write file ok %s", target)
+	}
+
+	if build != nil {
+		rect := image.Rect(layout.offx, layout.offy, layout.offx+bounds.Dx()*cellsize, layout.offy+bounds.Dy()*cellsize)
+		err = build.render(canvas, rect, srcimg, bounds.Dx(), bounds.Dy(), cellsize, layout.dpi, tiffcompress, bigtiff, workernum)
+		if err != nil {
+			return err
+		}
+	}
+
+	if anim == nil {
+		err = finish_job(db, job)
+		if err != nil {
+			loggo.Error("gen_target finish job fail %s %s", job, err)
+		}
+	}
+
+	return nil
+}
+
+func write_target(dst *image.RGBA, target string, dpi int, tiffcompress bool, bigtiff bool, workernum int) error {
+	if strings.HasSuffix(strings.ToLower(target), ".jpg") && (dst.Bounds().Dx() > 65535 || dst.Bounds().Dy() > 65535) {
+		loggo.Error("write_target jpg max 65535 pixel per side, use png or tif %s %d*%d", target, dst.Bounds().Dx(), dst.Bounds().Dy())
+		return errors.New("too big for jpg")
+	}
 
-	loggo.Info("gen_target start write file %s", target)
 	dstFile, err := os.Create(target)
 	if err != nil {
-		loggo.Error("gen_target Create fail %s %s", target, err)
+		loggo.Error("write_target Create fail %s %s", target, err)
 		return err
 	}
 	defer dstFile.Close()
 
 	if strings.HasSuffix(strings.ToLower(target), ".png") {
-		err = png.Encode(dstFile, dst)
+		var w io.Writer = dstFile
+		if dpi > 0 {
+			w = png_dpi_writer(w, dpi)
+		}
+		err = png.Encode(w, dst)
 	} else if strings.HasSuffix(strings.ToLower(target), ".jpg") {
-		err = jpeg.Encode(dstFile, dst, &jpeg.Options{Quality: 100})
+		var w io.Writer = dstFile
+		if dpi > 0 {
+			w = jpeg_dpi_writer(w, dpi)
+		}
+		if !dst.Opaque() {
+			loggo.Info("write_target jpg has no alpha, transparent parts put on white %s", target)
+			flatten_white(dst)
+		}
+		err = jpeg.Encode(w, dst, &jpeg.Options{Quality: 100})
+	} else if strings.HasSuffix(strings.ToLower(target), ".tif") || strings.HasSuffix(strings.ToLower(target), ".tiff") {
+		err = write_tiff(dstFile, dst, dpi, tiffcompress, bigtiff, workernum)
 	}
 	if err != nil {
-		loggo.Error("gen_target Encode fail %s %s", target, err)
+		loggo.Error("write_target Encode fail %s %s", target, err)
 		return err
 	}
 
-	loggo.Info("gen_target write file ok %s", target)
-
 	return nil
 }
 
-func gen_target_pixel(src color.RGBA, x int, y int, dst *image.RGBA, db *bolt.DB, bucket_name string, pixelsize int, scalealg string, cachemap *sync.Map, cached *int32) {
-
-	var minimgs []image.Image
+func load_thumb(db *bolt.DB, thumb_bucket_name string, filename string) (image.Image, error) {
+	var thumb []byte
+	db.View(func(tx *bolt.Tx) error {
+		tb := tx.Bucket([]byte(thumb_bucket_name))
+		if tb == nil {
+			return nil
+		}
+		v := tb.Get([]byte(filename))
+		if v != nil {
+			thumb = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if thumb == nil {
+		return nil, errors.New("no thumb")
+	}
 
-	key := make_string(src.R, src.G, src.B)
-	v, ok := cachemap.Load(key)
-	if ok {
-		ci := v.(*CacheInfo)
-		minimgs = ci.img
+	img, _, err := image.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		return nil, err
 	}
+	return img, nil
+}
 
-	if len(minimgs) <= 0 {
-		if ok {
-			ci := v.(*CacheInfo)
-			ci.lock.Lock()
+// load_tile reads the first copy of the content still on disk and makes the
+// tile the same way calc_avg_color does.
+func load_tile(db *bolt.DB, root string, bucket_name string, hash string, scalealg string, pixelsize int) (image.Image, error) {
+	var fi FileInfo
+	var err error
+	db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(bucket_name)).Get([]byte(hash))
+		if v == nil {
+			err = errors.New("not in lib")
+			return nil
 		}
+		fi, err = decode_file_info(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		if len(minimgs) <= 0 {
-
-			mindiff := math.MaxFloat64
-			var mindiffnames []string
-			var minfi FileInfo
-
-			db.View(func(tx *bolt.Tx) error {
-				b := tx.Bucket([]byte(bucket_name))
-				b.ForEach(func(k, v []byte) error {
-
-					var b bytes.Buffer
-					b.Write(v)
-
-					dec := gob.NewDecoder(&b)
-					var fi FileInfo
-					err := dec.Decode(&fi)
-					if err != nil {
-						loggo.Error("gen_target_pixel database Decode fail %s %s", string(k), err)
-						os.Exit(1)
-					}
-
-					if minfi.R == fi.R && minfi.G == fi.G && minfi.B == fi.B {
-						mindiffnames = append(mindiffnames, fi.Filename)
-						return nil
-					}
-
-					tmp := color.RGBA{fi.R, fi.G, fi.B, 0}
-					diff := common.ColorDistance(src, tmp)
-					if diff < mindiff {
-						mindiff = diff
-						mindiffnames = mindiffnames[:0]
-						mindiffnames = append(mindiffnames, fi.Filename)
-						minfi = fi
-					}
+	var reader *os.File
+	path := ""
+	err = errors.New("no file")
+	for _, p := range fi.Paths {
+		path = resolve_path(root, p)
+		reader, err = os.Open(path)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
 
-					return nil
-				})
-				return nil
-			})
+	img, _, err := image.Decode(reader)
+	if err != nil {
+		return nil, err
+	}
 
-			for _, mindiffname := range mindiffnames {
-				reader, err := os.Open(mindiffname)
-				if err != nil {
-					loggo.Error("gen_target_pixel Open fail %s %s", mindiffname, err)
-					os.Exit(1)
-				}
-				defer reader.Close()
+	img = apply_orientation(img, fi.Orientation)
 
-				minimg, _, err := image.Decode(reader)
-				if err != nil {
-					loggo.Error("gen_target_pixel Decode fail %s %s", mindiffname, err)
-					return
-				}
+	crop := fi.Crop
+	if crop.Empty() {
+		crop = calc_crop(img.Bounds())
+	}
 
-				scale := getScaler(scalealg)
+	return calc_img(img, path, crop, getScaler(scalealg), pixelsize)
+}
 
-				minimg, err = calc_img(minimg, mindiffname, scale, pixelsize)
-				if err != nil {
-					loggo.Error("gen_target_pixel calc_img image fail %s %s", mindiffname, err)
-					return
-				}
+// gen_target_pixel draws the tile best matching src at pos and returns its key.
+func gen_target_pixel(src color.RGBA, pos image.Point, dst *image.RGBA, db *bolt.DB, mix *LibMix, pixelsize int, scalealg string, flat bool,
+	top *TopSelect, tc *TileCache, ts *TransformSet, sig []color.RGBA, style *TileStyle) string {
 
-				minimgs = append(minimgs, minimg)
-			}
+	lr, ml := mix.choose(db, src, top)
 
-			v, ok := cachemap.Load(key)
-			if ok {
-				ci := v.(*CacheInfo)
-				ci.img = minimgs
+	// a random one of the matches, the next one if it can not be loaded
+	if len(ml.hashes) > 0 {
+		start := ml.pick()
+		for i := range ml.hashes {
+			hash := ml.hashes[(start+i)%len(ml.hashes)]
+			if gen_target_tile(hash, pos, dst, db, lr, pixelsize, scalealg, flat, tc, ts, sig, style, src) {
+				return hash
 			}
-		} else {
-			atomic.AddInt32(cached, 1)
 		}
-
-		if ok {
-			ci := v.(*CacheInfo)
-			ci.lock.Unlock()
-		}
-	} else {
-		atomic.AddInt32(cached, 1)
 	}
 
-	var minimg image.Image
-	minimg = minimgs[common.RandInt31n(len(minimgs))]
+	loggo.Error("gen_target_pixel no pic for %s", make_string(src.R, src.G, src.B))
+	return ""
+}
 
-	if common.RandInt()%2 == 0 {
-		flippedImg := image.NewRGBA(minimg.Bounds())
-		for j := 0; j < minimg.Bounds().Dy(); j++ {
-			for i := 0; i < minimg.Bounds().Dx(); i++ {
-				flippedImg.Set((minimg.Bounds().Dx()-1)-i, j, minimg.At(i, j))
-			}
+func gen_target_tile(hash string, pos image.Point, dst *image.RGBA, db *bolt.DB, lr *LibRender, pixelsize int, scalealg string,
+	flat bool, tc *TileCache, ts *TransformSet, sig []color.RGBA, style *TileStyle, src color.RGBA) bool {
+	if hash == "" || lr == nil {
+		return false
+	}
+
+	minimg, err := tc.load(hash, func() (image.Image, error) {
+		img, err := load_cell(db, lr.root, lr.bucket_name, lr.tile_bucket_name, lr.draw_bucket_name, hash, scalealg, pixelsize, flat)
+		if err != nil {
+			return nil, err
 		}
-		minimg = flippedImg
+		rgba := style.fit(to_rgba(img), getScaler(scalealg))
+		lr.tone.apply(rgba, rgba.Bounds())
+		return rgba, nil
+	})
+	if err != nil {
+		loggo.Error("gen_target_tile load_cell fail %s %s", hash, err)
+		return false
 	}
 
-	draw.Copy(dst, image.Point{x * pixelsize, y * pixelsize}, minimg, minimg.Bounds(), draw.Over, nil)
+	draw_tile(minimg.(*image.RGBA), pos, dst, ts, sig, style, lr.tone.color(src))
+	return true
+}
+
+// draw_tile draws the tile at pos with one of the allowed transforms, sig is
+// the signature and src the color of the source cell.
+func draw_tile(minimg *image.RGBA, pos image.Point, dst *image.RGBA, ts *TransformSet, sig []color.RGBA, style *TileStyle, src color.RGBA) {
+	minimg = apply_transform(minimg, ts.choose(minimg, sig))
+	if style != nil {
+		style.draw(minimg, pos, dst, src)
+		return
+	}
+	draw.Copy(dst, pos, minimg, minimg.Bounds(), draw.Over, nil)
 }
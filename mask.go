@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"image"
+	"image/color"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Mask tells for every cell of the source grid if it is drawn as mosaic, the
+// other cells show the source photo itself. A cell takes the color of the mask
+// at its center, black is photo.
+type Mask struct {
+	gridx int
+	gridy int
+	cells []color.RGBA
+	photo image.Image
+	crop  image.Rectangle
+}
+
+type MaskPoint struct {
+	x float64
+	y float64
+}
+
+func (m *Mask) mosaic(x int, y int) bool {
+	c := m.cells[y*m.gridx+x]
+	return c.R != 0 || c.G != 0 || c.B != 0
+}
+
+func (m *Mask) count() int {
+	n := 0
+	for y := 0; y < m.gridy; y++ {
+		for x := 0; x < m.gridx; x++ {
+			if m.mosaic(x, y) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func parse_mask_numbers(str string, sep string) ([]float64, error) {
+	var ret []float64
+	for _, s := range strings.FieldsFunc(str, func(r rune) bool { return strings.ContainsRune(sep, r) }) {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+// parse_mask_shapes reads rects "x,y,w,h;..." and polygons "x,y x,y x,y;..." in
+// source pixels, a rect is returned as a polygon too.
+func parse_mask_shapes(rects string, polys string) ([][]MaskPoint, error) {
+	var shapes [][]MaskPoint
+	for _, r := range strings.Split(rects, ";") {
+		if strings.TrimSpace(r) == "" {
+			continue
+		}
+		v, err := parse_mask_numbers(r, ", ")
+		if err != nil || len(v) != 4 {
+			loggo.Error("parse_mask_shapes rect fail %s, use x,y,w,h", r)
+			return nil, errors.New("mask rect error")
+		}
+		shapes = append(shapes, []MaskPoint{{v[0], v[1]}, {v[0] + v[2], v[1]}, {v[0] + v[2], v[1] + v[3]}, {v[0], v[1] + v[3]}})
+	}
+	for _, p := range strings.Split(polys, ";") {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		v, err := parse_mask_numbers(p, ", ")
+		if err != nil || len(v) < 6 || len(v)%2 != 0 {
+			loggo.Error("parse_mask_shapes polygon fail %s, use at least 3 points x,y x,y x,y", p)
+			return nil, errors.New("mask polygon error")
+		}
+		var shape []MaskPoint
+		for i := 0; i < len(v); i += 2 {
+			shape = append(shape, MaskPoint{v[i], v[i+1]})
+		}
+		shapes = append(shapes, shape)
+	}
+	return shapes, nil
+}
+
+func in_polygon(p MaskPoint, poly []MaskPoint) bool {
+	in := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		a := poly[i]
+		b := poly[j]
+		if (a.y > p.y) != (b.y > p.y) && p.x < (b.x-a.x)*(p.y-a.y)/(b.y-a.y)+a.x {
+			in = !in
+		}
+	}
+	return in
+}
+
+// load_mask builds the mask of the gridx*gridy cells parse_src made of src. The
+// mask image is stretched over the whole source, the shapes are added as white.
+func load_mask(photo image.Image, maskfile string, rects string, polys string, invert bool, layout *PrintLayout, gridx int, gridy int) (*Mask, error) {
+	loggo.Info("load_mask %s rect %s polygon %s invert %v", maskfile, rects, polys, invert)
+
+	shapes, err := parse_mask_shapes(rects, polys)
+	if err != nil {
+		return nil, err
+	}
+
+	// photo is the decoded source for the cells left out, parse_src only kept the grid
+	bounds := photo.Bounds()
+
+	crop := bounds
+	if layout != nil {
+		crop = fit_crop(bounds, layout.gridx, layout.gridy)
+	}
+
+	var maskimg image.Image
+	if maskfile != "" {
+		file, err := os.Open(maskfile)
+		if err != nil {
+			loggo.Error("load_mask Open fail %s %s", maskfile, err)
+			return nil, err
+		}
+		defer file.Close()
+		maskimg, _, err = image.Decode(file)
+		if err != nil {
+			loggo.Error("load_mask Decode image fail %s %s", maskfile, err)
+			return nil, err
+		}
+	}
+
+	white := color.RGBA{255, 255, 255, 255}
+	m := &Mask{gridx: gridx, gridy: gridy, cells: make([]color.RGBA, gridx*gridy), photo: photo, crop: crop}
+	for y := 0; y < gridy; y++ {
+		for x := 0; x < gridx; x++ {
+			// the center of the cell in source pixels
+			p := MaskPoint{float64(crop.Min.X) + (float64(x)+0.5)*float64(crop.Dx())/float64(gridx),
+				float64(crop.Min.Y) + (float64(y)+0.5)*float64(crop.Dy())/float64(gridy)}
+
+			var c color.RGBA
+			if maskimg != nil {
+				mb := maskimg.Bounds()
+				mx := mb.Min.X + int((p.x-float64(bounds.Min.X))*float64(mb.Dx())/float64(bounds.Dx()))
+				my := mb.Min.Y + int((p.y-float64(bounds.Min.Y))*float64(mb.Dy())/float64(bounds.Dy()))
+				r, g, b, a := maskimg.At(common.MinOfInt(mx, mb.Max.X-1), common.MinOfInt(my, mb.Max.Y-1)).RGBA()
+				if a != 0 {
+					c = color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255}
+				}
+			}
+			for _, shape := range shapes {
+				if in_polygon(p, shape) {
+					c = white
+				}
+			}
+			if invert {
+				if c.R != 0 || c.G != 0 || c.B != 0 {
+					c = color.RGBA{}
+				} else {
+					c = white
+				}
+			}
+			m.cells[y*gridx+x] = c
+		}
+	}
+
+	loggo.Info("load_mask ok mosaic cells %d/%d", m.count(), gridx*gridy)
+	return m, nil
+}
+
+// signature is what the mask changes in a job.
+func (m *Mask) signature() string {
+	if m == nil {
+		return "off"
+	}
+	buf := make([]byte, 0, len(m.cells)*3)
+	for _, c := range m.cells {
+		buf = append(buf, c.R, c.G, c.B)
+	}
+	return common.GetXXHashString(string(buf))
+}
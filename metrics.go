@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// QualityReport compares the generated mosaic with the source grid. The error
+// is the color distance between a cell of the source and the average of the
+// tile chosen for it, PSNR and SSIM compare the source with the mosaic scaled
+// down to one pixel per cell.
+type QualityReport struct {
+	Target       string      `json:"target"`
+	GridX        int         `json:"gridx"`
+	GridY        int         `json:"gridy"`
+	Cells        int         `json:"cells"`
+	MeanError    float64     `json:"mean_error"`
+	MedianError  float64     `json:"median_error"`
+	P90Error     float64     `json:"p90_error"`
+	MaxError     float64     `json:"max_error"`
+	PSNR         float64     `json:"psnr"`
+	SSIM         float64     `json:"ssim"`
+	UniqueTiles  int         `json:"unique_tiles"`
+	MaxReuse     int         `json:"max_reuse"`
+	MaxReuseTile string      `json:"max_reuse_tile"`
+	CellError    [][]float64 `json:"cell_error"`
+}
+
+// cell_average is the mean color of the part of rect inside img.
+func cell_average(img *image.RGBA, rect image.Rectangle) color.RGBA {
+	rect = rect.Intersect(img.Bounds())
+	if rect.Empty() {
+		return color.RGBA{}
+	}
+	var sumR, sumG, sumB int64
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		pix := img.Pix[img.PixOffset(rect.Min.X, y):]
+		for x := 0; x < rect.Dx(); x++ {
+			sumR += int64(pix[x*4])
+			sumG += int64(pix[x*4+1])
+			sumB += int64(pix[x*4+2])
+		}
+	}
+	n := int64(rect.Dx() * rect.Dy())
+	return color.RGBA{uint8(sumR / n), uint8(sumG / n), uint8(sumB / n), 0}
+}
+
+func luma(c color.RGBA) float64 {
+	return 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+}
+
+// calc_ssim is the mean SSIM of the luma over 8x8 windows, half overlapped,
+// leaving out the windows over a cell set in skip.
+func calc_ssim(a []float64, b []float64, skip []bool, w int, h int) float64 {
+	const c1 = (0.01 * 255) * (0.01 * 255)
+	const c2 = (0.03 * 255) * (0.03 * 255)
+
+	win := 8
+	if w < win {
+		win = w
+	}
+	if h < win {
+		win = h
+	}
+	step := win / 2
+	if step < 1 {
+		step = 1
+	}
+
+	sum := 0.0
+	num := 0
+	for y := 0; y+win <= h; y += step {
+		for x := 0; x+win <= w; x += step {
+			if skip_window(skip, w, x, y, win) {
+				continue
+			}
+			var ma, mb float64
+			for j := y; j < y+win; j++ {
+				for i := x; i < x+win; i++ {
+					ma += a[j*w+i]
+					mb += b[j*w+i]
+				}
+			}
+			n := float64(win * win)
+			ma /= n
+			mb /= n
+
+			var va, vb, cov float64
+			for j := y; j < y+win; j++ {
+				for i := x; i < x+win; i++ {
+					da := a[j*w+i] - ma
+					db := b[j*w+i] - mb
+					va += da * da
+					vb += db * db
+					cov += da * db
+				}
+			}
+			va /= n - 1
+			vb /= n - 1
+			cov /= n - 1
+			if win == 1 {
+				va, vb, cov = 0, 0, 0
+			}
+
+			sum += ((2*ma*mb + c1) * (2*cov + c2)) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+			num++
+		}
+	}
+	if num == 0 {
+		return 0
+	}
+	return sum / float64(num)
+}
+
+func skip_window(skip []bool, w int, x int, y int, win int) bool {
+	if skip == nil {
+		return false
+	}
+	for j := y; j < y+win; j++ {
+		for i := x; i < x+win; i++ {
+			if skip[j*w+i] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// calc_quality measures the mosaic drawn into dst, chosen holds the tile key of
+// every cell, empty where no tile was drawn. With a tone both sides are toned.
+func calc_quality(target string, srcimg image.Image, chosen [][]string, dst *image.RGBA, layout *PrintLayout, pixelsize int,
+	db *bolt.DB, libof map[string]*LibRender, tone *Tone, cells []int) *QualityReport {
+	bounds := srcimg.Bounds()
+	w := bounds.Dx()
+	h := bounds.Dy()
+
+	uses := make(map[string]int)
+	for y := range chosen {
+		for _, k := range chosen[y] {
+			if k != "" {
+				uses[k]++
+			}
+		}
+	}
+
+	tilecolor := make(map[string]color.RGBA)
+	db.View(func(tx *bolt.Tx) error {
+		for k := range uses {
+			lr, ok := libof[k]
+			if !ok {
+				continue
+			}
+			v := tx.Bucket([]byte(lr.tile_bucket_name)).Get([]byte(k))
+			if v == nil {
+				continue
+			}
+			ti, err := decode_tile_info(v)
+			if err != nil {
+				continue
+			}
+			tilecolor[k] = tone.color(color.RGBA{ti.R, ti.G, ti.B, 0})
+		}
+		return nil
+	})
+
+	qr := &QualityReport{Target: target, GridX: w, GridY: h}
+
+	var errs []float64
+	var mse float64
+	msecells := 0
+	srcluma := make([]float64, w*h)
+	dstluma := make([]float64, w*h)
+	skip := make([]bool, w*h)
+	qr.CellError = make([][]float64, h)
+	for y := 0; y < h; y++ {
+		qr.CellError[y] = make([]float64, w)
+		for x := 0; x < w; x++ {
+			src, a := src_color(srcimg, bounds.Min.X+x, bounds.Min.Y+y)
+			src = tone.color(src)
+			cell := image.Rect(layout.offx+x*pixelsize, layout.offy+y*pixelsize, layout.offx+(x+1)*pixelsize, layout.offy+(y+1)*pixelsize)
+			avg := cell_average(dst, cell)
+
+			diff := 0.0
+			if tc, ok := tilecolor[chosen[y][x]]; ok {
+				diff = common.ColorDistance(src, tc)
+			} else {
+				// no tile, what is there: the photo out of the mask or black
+				diff = common.ColorDistance(src, avg)
+			}
+			// masked out or transparent, no tile to judge
+			if cells[y*w+x] < 0 || (a == 0 && chosen[y][x] == "") {
+				diff = 0
+				skip[y*w+x] = true
+			} else {
+				errs = append(errs, diff)
+				dr := float64(src.R) - float64(avg.R)
+				dg := float64(src.G) - float64(avg.G)
+				db := float64(src.B) - float64(avg.B)
+				mse += dr*dr + dg*dg + db*db
+				msecells++
+			}
+			qr.CellError[y][x] = round2(diff)
+
+			srcluma[y*w+x] = luma(src)
+			dstluma[y*w+x] = luma(avg)
+		}
+	}
+
+	qr.Cells = len(errs)
+	if len(errs) == 0 {
+		errs = append(errs, 0)
+	}
+	sum := 0.0
+	for _, e := range errs {
+		sum += e
+	}
+	sort.Float64s(errs)
+	qr.MeanError = round2(sum / float64(len(errs)))
+	qr.MedianError = round2(errs[len(errs)/2])
+	qr.P90Error = round2(errs[len(errs)*9/10])
+	qr.MaxError = round2(errs[len(errs)-1])
+
+	if msecells > 0 {
+		mse /= float64(msecells * 3)
+	}
+	if mse > 0 {
+		qr.PSNR = round2(10 * math.Log10(255*255/mse))
+	} else {
+		// identical, keep it finite for json
+		qr.PSNR = 100
+	}
+	qr.SSIM = math.Round(calc_ssim(srcluma, dstluma, skip, w, h)*10000) / 10000
+
+	qr.UniqueTiles = len(uses)
+	for k, n := range uses {
+		if n > qr.MaxReuse || (n == qr.MaxReuse && k < qr.MaxReuseTile) {
+			qr.MaxReuse = n
+			qr.MaxReuseTile = k
+		}
+	}
+
+	return qr
+}
+
+func write_quality(qr *QualityReport, filename string) error {
+	loggo.Info("quality cells %d error mean %.2f median %.2f p90 %.2f max %.2f", qr.Cells, qr.MeanError, qr.MedianError, qr.P90Error, qr.MaxError)
+	loggo.Info("quality psnr %.2fdB ssim %.4f unique tiles %d max reuse %d %s", qr.PSNR, qr.SSIM, qr.UniqueTiles, qr.MaxReuse, qr.MaxReuseTile)
+
+	if filename == "" {
+		return nil
+	}
+	data, err := json.Marshal(qr)
+	if err != nil {
+		loggo.Error("write_quality Marshal fail %s %s", filename, err)
+		return err
+	}
+	err = ioutil.WriteFile(filename, data, 0644)
+	if err != nil {
+		loggo.Error("write_quality WriteFile fail %s %s", filename, err)
+		return err
+	}
+	loggo.Info("write_quality ok %s", filename)
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCalcSSIMSkip(t *testing.T) {
+	// the left half is background in the mosaic, the right half matches
+	w, h := 16, 8
+	src := make([]float64, w*h)
+	dst := make([]float64, w*h)
+	skip := make([]bool, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			src[y*w+x] = float64((x*37 + y*91) % 256)
+			if x < w/2 {
+				skip[y*w+x] = true
+			} else {
+				dst[y*w+x] = src[y*w+x]
+			}
+		}
+	}
+
+	all := calc_ssim(src, dst, nil, w, h)
+	if all >= 0.9 {
+		t.Errorf("ssim over all cells %.4f, want below 0.9", all)
+	}
+	if masked := calc_ssim(src, dst, skip, w, h); masked < 0.9999 {
+		t.Errorf("ssim without the masked cells %.4f, want 1", masked)
+	}
+	if same := calc_ssim(src, src, nil, w, h); same < 0.9999 {
+		t.Errorf("ssim of the same %.4f, want 1", same)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"golang.org/x/image/draw"
+	"image"
+	"math/bits"
+)
+
+// calc_dhash is the 64 bit difference hash of the tile, one bit per pair of
+// horizontally adjacent pixels of a 9x8 gray version. Resized copies and burst
+// shots end up a few bits apart.
+func calc_dhash(img image.Image) uint64 {
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.CatmullRom.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.GrayAt(x, y).Y < small.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// dhash_size is the side the cropped picture is scaled to for its dhash, the
+// same for every pixel size indexed.
+const dhash_size = 64
+
+// calc_crop_dhash is the dhash of the crop of the decoded file.
+func calc_crop_dhash(img image.Image, crop image.Rectangle) uint64 {
+	rect := image.Rect(0, 0, dhash_size, dhash_size)
+	src := image.NewRGBA(rect)
+	draw.BiLinear.Scale(src, rect, img, crop, draw.Src, nil)
+	return calc_dhash(src)
+}
+
+func hamming(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// near_clusters groups the hashes at most maxdist bits apart, transitively, and
+// returns the cluster of each. Entries without a hash, or a negative maxdist,
+// stay alone. Hashes within maxdist share one of maxdist+1 bands exactly, so
+// only hashes in the same band bucket are compared.
+func near_clusters(hashes []uint64, has []bool, maxdist int) []int {
+	parent := make([]int, len(hashes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+
+	if maxdist >= 0 {
+		bands := maxdist + 1
+		if bands > 64 {
+			bands = 64
+		}
+		buckets := make([]map[uint64][]int, bands)
+		for b := range buckets {
+			buckets[b] = make(map[uint64][]int)
+		}
+
+		for i, h := range hashes {
+			if !has[i] {
+				continue
+			}
+			for b := 0; b < bands; b++ {
+				lo := b * 64 / bands
+				hi := (b + 1) * 64 / bands
+				seg := (h >> uint(lo)) & (1<<uint(hi-lo) - 1)
+				for _, j := range buckets[b][seg] {
+					if find(i) != find(j) && hamming(h, hashes[j]) <= maxdist {
+						parent[find(i)] = find(j)
+					}
+				}
+				buckets[b][seg] = append(buckets[b][seg], i)
+			}
+		}
+	}
+
+	ret := make([]int, len(hashes))
+	for i := range ret {
+		ret[i] = find(i)
+	}
+	return ret
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+)
+
+// preview_size is the tile size of -preview renders, a thumb of this size is
+// cached for every content when the lib is loaded.
+const preview_size = 16
+
+// load_cell returns the image drawn for a tile: a flat block of its average
+// color, its cached thumb, or the tile made from the original file for entries
+// indexed without a thumb.
+func load_cell(db *bolt.DB, root string, bucket_name string, tile_bucket_name string, thumb_bucket_name string, hash string, scalealg string, pixelsize int, flat bool) (image.Image, error) {
+	if flat {
+		var ti TileInfo
+		err := errors.New("no tile")
+		db.View(func(tx *bolt.Tx) error {
+			v := tx.Bucket([]byte(tile_bucket_name)).Get([]byte(hash))
+			if v != nil {
+				ti, err = decode_tile_info(v)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		img := image.NewRGBA(image.Rect(0, 0, pixelsize, pixelsize))
+		draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{ti.R, ti.G, ti.B, 255}}, image.Point{}, draw.Src)
+		return img, nil
+	}
+
+	img, err := load_thumb(db, thumb_bucket_name, hash)
+	if err == nil {
+		return img, nil
+	}
+	// entries indexed by older versions have no thumb, use the original file
+	return load_tile(db, root, bucket_name, hash, scalealg, pixelsize)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/esrrhs/gohome/loggo"
+	"golang.org/x/image/draw"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// PrintLayout describes where the mosaic grid sits on the output canvas.
+// For normal output the canvas is exactly the grid; for print output the
+// canvas is the trim size plus bleed, plus an optional crop mark margin.
+type PrintLayout struct {
+	dpi       int
+	pixelsize int
+	gridx     int
+	gridy     int
+	canvasx   int
+	canvasy   int
+	offx      int
+	offy      int
+	trim      image.Rectangle
+	bleed     int
+	mark      int
+}
+
+func unit_to_inch(v float64, unit string) (float64, error) {
+	if unit == "cm" {
+		return v / 2.54, nil
+	} else if unit == "mm" {
+		return v / 25.4, nil
+	} else if unit == "inch" {
+		return v, nil
+	}
+	return 0, errors.New("unknown unit " + unit)
+}
+
+func calc_print_layout(width float64, height float64, unit string, dpi int, bleed float64, cropmarks bool, srcsize int) (*PrintLayout, error) {
+	if width <= 0 || height <= 0 || dpi <= 0 || srcsize <= 0 || bleed < 0 {
+		return nil, errors.New("print size error")
+	}
+
+	wi, err := unit_to_inch(width, unit)
+	if err != nil {
+		return nil, err
+	}
+	hi, _ := unit_to_inch(height, unit)
+	bi, _ := unit_to_inch(bleed, unit)
+
+	trimx := int(math.Round(wi * float64(dpi)))
+	trimy := int(math.Round(hi * float64(dpi)))
+	bleedpx := int(math.Round(bi * float64(dpi)))
+
+	// srcsize cells on the long side of the trim area
+	long := trimx
+	if trimy > long {
+		long = trimy
+	}
+	pixelsize := (long + srcsize - 1) / srcsize
+	if pixelsize <= 0 {
+		return nil, errors.New("print size too small")
+	}
+
+	mark := 0
+	if cropmarks {
+		// 3/8 inch outside the bleed for the marks
+		mark = dpi * 3 / 8
+	}
+
+	areax := trimx + 2*bleedpx
+	areay := trimy + 2*bleedpx
+	gridx := (areax + pixelsize - 1) / pixelsize
+	gridy := (areay + pixelsize - 1) / pixelsize
+
+	pl := &PrintLayout{
+		dpi:       dpi,
+		pixelsize: pixelsize,
+		gridx:     gridx,
+		gridy:     gridy,
+		canvasx:   areax + 2*mark,
+		canvasy:   areay + 2*mark,
+		offx:      mark + (areax-gridx*pixelsize)/2,
+		offy:      mark + (areay-gridy*pixelsize)/2,
+		trim:      image.Rect(mark+bleedpx, mark+bleedpx, mark+bleedpx+trimx, mark+bleedpx+trimy),
+		bleed:     bleedpx,
+		mark:      mark,
+	}
+
+	loggo.Info("calc_print_layout %.2fx%.2f%s dpi=%d trim=%dx%d bleed=%d mark=%d pixelsize=%d grid=%dx%d canvas=%dx%d",
+		width, height, unit, dpi, trimx, trimy, bleedpx, mark, pixelsize, gridx, gridy, pl.canvasx, pl.canvasy)
+
+	return pl, nil
+}
+
+func default_layout(bounds image.Rectangle, pixelsize int, dpi int) *PrintLayout {
+	lenx := bounds.Dx() * pixelsize
+	leny := bounds.Dy() * pixelsize
+	return &PrintLayout{
+		dpi:       dpi,
+		pixelsize: pixelsize,
+		gridx:     bounds.Dx(),
+		gridy:     bounds.Dy(),
+		canvasx:   lenx,
+		canvasy:   leny,
+		trim:      image.Rect(0, 0, lenx, leny),
+	}
+}
+
+// area returns the part of the canvas covered by tiles, trim plus bleed.
+func (pl *PrintLayout) area() image.Rectangle {
+	return pl.trim.Inset(-pl.bleed)
+}
+
+// fit_crop is the centered part of bounds with the aspect of gridx*gridy.
+func fit_crop(bounds image.Rectangle, gridx int, gridy int) image.Rectangle {
+	lenx := bounds.Dx()
+	leny := bounds.Dy()
+
+	cropx := lenx
+	cropy := lenx * gridy / gridx
+	if cropy > leny {
+		cropy = leny
+		cropx = leny * gridx / gridy
+	}
+	startx := bounds.Min.X + (lenx-cropx)/2
+	starty := bounds.Min.Y + (leny-cropy)/2
+	return image.Rect(startx, starty, startx+cropx, starty+cropy)
+}
+
+// fit_src scales and center crops the source so it covers exactly gridx*gridy cells.
+func fit_src(img image.Image, scale draw.Scaler, gridx int, gridy int) image.Image {
+	rect := image.Rectangle{image.Point{0, 0}, image.Point{gridx, gridy}}
+	dst := image.NewRGBA(rect)
+	scale.Scale(dst, rect, img, fit_crop(img.Bounds(), gridx, gridy), draw.Over, nil)
+	return dst
+}
+
+func draw_crop_marks(dst *image.RGBA, pl *PrintLayout) {
+	if pl.mark <= 0 {
+		return
+	}
+
+	thick := pl.dpi / 288
+	if thick < 1 {
+		thick = 1
+	}
+	// keep a small gap so the marks never reach into the bleed
+	gap := pl.dpi / 32
+	black := &image.Uniform{color.RGBA{0, 0, 0, 255}}
+	area := pl.area()
+
+	for _, x := range []int{pl.trim.Min.X, pl.trim.Max.X - thick} {
+		draw.Draw(dst, image.Rect(x, 0, x+thick, area.Min.Y-gap), black, image.Point{}, draw.Src)
+		draw.Draw(dst, image.Rect(x, area.Max.Y+gap, x+thick, pl.canvasy), black, image.Point{}, draw.Src)
+	}
+	for _, y := range []int{pl.trim.Min.Y, pl.trim.Max.Y - thick} {
+		draw.Draw(dst, image.Rect(0, y, area.Min.X-gap, y+thick), black, image.Point{}, draw.Src)
+		draw.Draw(dst, image.Rect(area.Max.X+gap, y, pl.canvasx, y+thick), black, image.Point{}, draw.Src)
+	}
+}
+
+// inject_writer writes chunk into the stream once at bytes have passed through,
+// used to put density metadata behind the header the std encoders emit.
+type inject_writer struct {
+	w     io.Writer
+	at    int
+	n     int
+	chunk []byte
+}
+
+func (iw *inject_writer) Write(p []byte) (int, error) {
+	written := 0
+	if iw.chunk != nil && iw.n+len(p) >= iw.at {
+		head := iw.at - iw.n
+		n, err := iw.w.Write(p[:head])
+		written += n
+		iw.n += n
+		if err != nil {
+			return written, err
+		}
+		_, err = iw.w.Write(iw.chunk)
+		if err != nil {
+			return written, err
+		}
+		iw.chunk = nil
+		p = p[head:]
+	}
+	n, err := iw.w.Write(p)
+	written += n
+	iw.n += n
+	return written, err
+}
+
+// png_dpi_writer adds a pHYs chunk right after the IHDR chunk.
+func png_dpi_writer(w io.Writer, dpi int) io.Writer {
+	ppm := uint32(math.Round(float64(dpi) / 0.0254))
+
+	data := make([]byte, 9)
+	binary.BigEndian.PutUint32(data[0:4], ppm)
+	binary.BigEndian.PutUint32(data[4:8], ppm)
+	data[8] = 1 // unit is meter
+
+	chunk := make([]byte, 0, 21)
+	chunk = binary.BigEndian.AppendUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, "pHYs"...)
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	// signature 8 + IHDR 4+4+13+4
+	return &inject_writer{w: w, at: 33, chunk: chunk}
+}
+
+// jpeg_dpi_writer adds a JFIF APP0 segment with the density right after SOI.
+func jpeg_dpi_writer(w io.Writer, dpi int) io.Writer {
+	density := dpi
+	if density > 65535 {
+		density = 65535
+	}
+
+	chunk := []byte{0xFF, 0xE0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 2, 1}
+	chunk = binary.BigEndian.AppendUint16(chunk, uint16(density))
+	chunk = binary.BigEndian.AppendUint16(chunk, uint16(density))
+	chunk = append(chunk, 0, 0)
+
+	return &inject_writer{w: w, at: 2, chunk: chunk}
+}
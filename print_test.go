@@ -0,0 +1,57 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestCalcPrintLayout(t *testing.T) {
+	tests := []struct {
+		name      string
+		width     float64
+		height    float64
+		unit      string
+		dpi       int
+		bleed     float64
+		cropmarks bool
+		srcsize   int
+		want      PrintLayout
+	}{
+		{"inch", 10, 8, "inch", 100, 0.1, false, 100, PrintLayout{dpi: 100, pixelsize: 10, gridx: 102, gridy: 82,
+			canvasx: 1020, canvasy: 820, trim: image.Rect(10, 10, 1010, 810), bleed: 10}},
+		{"crop marks", 10, 8, "inch", 100, 0.1, true, 100, PrintLayout{dpi: 100, pixelsize: 10, gridx: 102, gridy: 82,
+			canvasx: 1094, canvasy: 894, offx: 37, offy: 37, trim: image.Rect(47, 47, 1047, 847), bleed: 10, mark: 37}},
+		{"cm grid over the trim", 25.4, 25.4, "cm", 300, 0, false, 64, PrintLayout{dpi: 300, pixelsize: 47, gridx: 64, gridy: 64,
+			canvasx: 3000, canvasy: 3000, offx: -4, offy: -4, trim: image.Rect(0, 0, 3000, 3000)}},
+		{"mm portrait", 100, 200, "mm", 254, 0, false, 10, PrintLayout{dpi: 254, pixelsize: 200, gridx: 5, gridy: 10,
+			canvasx: 1000, canvasy: 2000, trim: image.Rect(0, 0, 1000, 2000)}},
+	}
+	for _, tt := range tests {
+		pl, err := calc_print_layout(tt.width, tt.height, tt.unit, tt.dpi, tt.bleed, tt.cropmarks, tt.srcsize)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if *pl != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.name, *pl, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		width, height float64
+		unit          string
+		dpi           int
+		bleed         float64
+		srcsize       int
+	}{
+		{0, 8, "inch", 100, 0, 100},
+		{10, 8, "inch", 0, 0, 100},
+		{10, 8, "inch", 100, -1, 100},
+		{10, 8, "inch", 100, 0, 0},
+		{10, 8, "pt", 100, 0, 100},
+	} {
+		if _, err := calc_print_layout(tt.width, tt.height, tt.unit, tt.dpi, tt.bleed, false, tt.srcsize); err == nil {
+			t.Errorf("calc_print_layout %+v no error", tt)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"image"
+	"image/color"
+	"math"
+	"time"
+)
+
+type TileCand struct {
+	hash    string
+	c       color.RGBA
+	cluster int
+}
+
+// load_tile_cands reads every tile of the pixel size in the libs, near
+// duplicates within neardist bits share one cluster.
+func load_tile_cands(db *bolt.DB, libs []*LibRender, neardist int, tone *Tone) []TileCand {
+	var cands []TileCand
+	var dhashes []uint64
+	var hasdhash []bool
+	seen := make(map[string]bool)
+	db.View(func(tx *bolt.Tx) error {
+		for _, lr := range libs {
+			b := tx.Bucket([]byte(lr.bucket_name))
+			tb := tx.Bucket([]byte(lr.tile_bucket_name))
+			if b == nil || tb == nil {
+				continue
+			}
+			tb.ForEach(func(k, v []byte) error {
+				// the same content in two libs is one tile
+				if seen[string(k)] {
+					return nil
+				}
+				seen[string(k)] = true
+				ti, err := decode_tile_info(v)
+				if err != nil {
+					loggo.Error("load_tile_cands Decode fail %s %s", string(k), err)
+					return nil
+				}
+				var fi FileInfo
+				fv := b.Get(k)
+				if fv != nil {
+					fi, _ = decode_file_info(fv)
+				}
+				cands = append(cands, TileCand{hash: string(k), c: tone.gray(color.RGBA{ti.R, ti.G, ti.B, 0})})
+				dhashes = append(dhashes, fi.DHash)
+				hasdhash = append(hasdhash, fi.HasDHash)
+				return nil
+			})
+		}
+		return nil
+	})
+
+	clusternum := 0
+	for i, c := range near_clusters(dhashes, hasdhash, neardist) {
+		cands[i].cluster = c
+		if c == i {
+			clusternum++
+		}
+	}
+	loggo.Info("load_tile_cands tiles %d clusters %d dist %d", len(cands), clusternum, neardist)
+
+	return cands
+}
+
+// assign_tiles picks the tile of every cell before anything is drawn, a cluster
+// of near duplicates counts as one image: it is used at most maxreuse times, 0
+// for no limit, and not again within neighbor cells. Cells are visited in random
+// order so the top rows do not use up the best matches. When every cluster is
+// ruled out maxreuse is given up first, then neighbor. Cells use rules out
+// get no tile.
+func assign_tiles(srcimg image.Image, cands []TileCand, maxreuse int, neighbor int, use func(x int, y int) bool, tone *Tone) [][]string {
+	bounds := srcimg.Bounds()
+	w := bounds.Dx()
+	h := bounds.Dy()
+
+	ret := make([][]string, h)
+	grid := make([][]int, h)
+	for y := range grid {
+		ret[y] = make([]string, w)
+		grid[y] = make([]int, w)
+		for x := range grid[y] {
+			grid[y][x] = -1
+		}
+	}
+
+	order := make([]int, w*h)
+	for i := range order {
+		order[i] = i
+	}
+	for i := len(order) - 1; i > 0; i-- {
+		j := int(common.RandInt31n(i + 1))
+		order[i], order[j] = order[j], order[i]
+	}
+
+	used := make([]int, len(cands))
+	mark := make([]int, len(cands))
+	fallback := 0
+	assigned := 0
+	last := time.Now()
+
+	for n, cell := range order {
+		x := cell % w
+		y := cell / w
+		if use != nil && !use(x, y) {
+			continue
+		}
+		src, _ := src_color(srcimg, bounds.Min.X+x, bounds.Min.Y+y)
+		src = tone.gray(src)
+
+		// clusters already placed around this cell
+		stamp := n + 1
+		for ny := y - neighbor; ny <= y+neighbor; ny++ {
+			for nx := x - neighbor; nx <= x+neighbor; nx++ {
+				if ny >= 0 && ny < h && nx >= 0 && nx < w && grid[ny][nx] >= 0 {
+					mark[grid[ny][nx]] = stamp
+				}
+			}
+		}
+
+		var ties []int
+		for pass := 0; pass < 3 && len(ties) == 0; pass++ {
+			mindiff := math.MaxFloat64
+			for i, cand := range cands {
+				if pass < 2 && mark[cand.cluster] == stamp {
+					continue
+				}
+				if pass < 1 && maxreuse > 0 && used[cand.cluster] >= maxreuse {
+					continue
+				}
+				diff := common.ColorDistance(src, cand.c)
+				if diff < mindiff {
+					mindiff = diff
+					ties = ties[:0]
+				}
+				if diff == mindiff {
+					ties = append(ties, i)
+				}
+			}
+			if pass == 1 {
+				fallback++
+			}
+		}
+		if len(ties) == 0 {
+			continue
+		}
+
+		pick := cands[ties[common.RandInt31n(len(ties))]]
+		ret[y][x] = pick.hash
+		grid[y][x] = pick.cluster
+		used[pick.cluster]++
+		assigned++
+
+		if time.Now().Sub(last) >= time.Second {
+			last = time.Now()
+			loggo.Info("assign_tiles progress=%d/%d fallback=%d", n+1, len(order), fallback)
+		}
+	}
+
+	clusters := 0
+	maxused := 0
+	for _, u := range used {
+		if u > 0 {
+			clusters++
+		}
+		if u > maxused {
+			maxused = u
+		}
+	}
+	loggo.Info("assign_tiles ok cells %d/%d clusters %d max reuse %d fallback %d", assigned, len(order), clusters, maxused, fallback)
+
+	return ret
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/esrrhs/gohome/common"
+	"math"
+	"sort"
+)
+
+// TopSelect widens the choice of tile for a cell from the exact ties of the best
+// match to the k nearest tiles and/or all tiles within dist of the best match,
+// picked at random with a weight of exp(-(diff-best)/falloff), so the further
+// from the best the rarer. falloff 0 picks them all alike.
+type TopSelect struct {
+	k       int
+	dist    float64
+	falloff float64
+}
+
+type MatchCand struct {
+	hash string
+	diff float64
+}
+
+// MatchList is what a color matched, cum holds the cumulative weights, nil when
+// all are alike, best is the distance of the best match.
+type MatchList struct {
+	hashes []string
+	cum    []float64
+	best   float64
+}
+
+func new_top_select(k int, dist float64, falloff float64) *TopSelect {
+	if k <= 0 && dist <= 0 {
+		return nil
+	}
+	return &TopSelect{k: k, dist: dist, falloff: falloff}
+}
+
+func (ts *TopSelect) choose(cands []MatchCand) *MatchList {
+	sort.Slice(cands, func(i, j int) bool {
+		if cands[i].diff != cands[j].diff {
+			return cands[i].diff < cands[j].diff
+		}
+		return cands[i].hash < cands[j].hash
+	})
+	if ts.k > 0 && len(cands) > ts.k {
+		cands = cands[:ts.k]
+	}
+
+	ml := &MatchList{}
+	if len(cands) == 0 {
+		return ml
+	}
+	best := cands[0].diff
+	ml.best = best
+	total := 0.0
+	for _, c := range cands {
+		if ts.dist > 0 && c.diff > best+ts.dist {
+			break
+		}
+		w := 1.0
+		if ts.falloff > 0 {
+			w = math.Exp(-(c.diff - best) / ts.falloff)
+		}
+		total += w
+		ml.hashes = append(ml.hashes, c.hash)
+		ml.cum = append(ml.cum, total)
+	}
+	return ml
+}
+
+// pick returns a random index into hashes by weight.
+func (ml *MatchList) pick() int {
+	if ml.cum == nil {
+		return int(common.RandInt31n(len(ml.hashes)))
+	}
+	r := float64(common.RandInt31n(1<<30)) / (1 << 30) * ml.cum[len(ml.cum)-1]
+	i := sort.SearchFloat64s(ml.cum, r)
+	if i >= len(ml.cum) {
+		i = len(ml.cum) - 1
+	}
+	return i
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestTopSelectChoose(t *testing.T) {
+	cands := func() []MatchCand {
+		return []MatchCand{{"e", 9}, {"b", 2}, {"a", 1}, {"d", 5}, {"c", 2}}
+	}
+	tests := []struct {
+		name    string
+		k       int
+		dist    float64
+		falloff float64
+		hashes  []string
+		cum     []float64
+	}{
+		{"top 3", 3, 0, 0, []string{"a", "b", "c"}, []float64{1, 2, 3}},
+		{"within dist", 0, 1, 0, []string{"a", "b", "c"}, []float64{1, 2, 3}},
+		{"top and dist", 2, 10, 0, []string{"a", "b"}, []float64{1, 2}},
+		{"k over all", 10, 0, 0, []string{"a", "b", "c", "d", "e"}, []float64{1, 2, 3, 4, 5}},
+		{"falloff", 0, 4, 1, []string{"a", "b", "c", "d"},
+			[]float64{1, 1 + math.Exp(-1), 1 + 2*math.Exp(-1), 1 + 2*math.Exp(-1) + math.Exp(-4)}},
+	}
+	for _, tt := range tests {
+		ml := new_top_select(tt.k, tt.dist, tt.falloff).choose(cands())
+		if !reflect.DeepEqual(ml.hashes, tt.hashes) || ml.best != 1 {
+			t.Errorf("%s: hashes %v best %v, want %v 1", tt.name, ml.hashes, ml.best, tt.hashes)
+			continue
+		}
+		for i := range tt.cum {
+			if math.Abs(ml.cum[i]-tt.cum[i]) > 1e-9 {
+				t.Errorf("%s: cum %v, want %v", tt.name, ml.cum, tt.cum)
+				break
+			}
+		}
+		for i := 0; i < 100; i++ {
+			if p := ml.pick(); p < 0 || p >= len(ml.hashes) {
+				t.Fatalf("%s: pick %d of %d", tt.name, p, len(ml.hashes))
+			}
+		}
+	}
+
+	if ts := new_top_select(0, 0, 1); ts != nil {
+		t.Errorf("new_top_select without k and dist %+v, want nil", ts)
+	}
+	if ml := new_top_select(3, 0, 0).choose(nil); len(ml.hashes) != 0 {
+		t.Errorf("no candidates %v", ml.hashes)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/esrrhs/gohome/loggo"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type DupGroup struct {
+	hash  string
+	paths []string
+	size  int64
+}
+
+// stats_lib reports the size of the lib, every group of files sharing one
+// content, and the clusters of contents looking alike within neardist bits.
+func stats_lib(database string, libname string, neardist int) error {
+	db, err := open_database(database)
+	if err != nil {
+		loggo.Error("stats_lib Open database fail %s %s", database, err)
+		return err
+	}
+	defer db.Close()
+
+	contents := 0
+	files := 0
+	var groups []DupGroup
+	var names []string
+	var dhashes []uint64
+	var hasdhash []bool
+	tiles := make(map[string]int)
+	root := ""
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(make_lib_bucket(libname)))
+		if b == nil {
+			return errors.New("no lib " + libname)
+		}
+		root = get_lib_root(tx, libname)
+
+		for _, name := range lib_sub_buckets(tx, libname) {
+			if strings.HasPrefix(name, "Tile:") {
+				tiles[name[strings.LastIndex(name, ":")+1:]] = tx.Bucket([]byte(name)).Stats().KeyN
+			}
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			fi, err := decode_file_info(v)
+			if err != nil {
+				loggo.Error("stats_lib Decode fail, skip %s %s", string(k), err)
+				return nil
+			}
+			contents++
+			files += len(fi.Paths)
+			name := fi.Hash
+			if len(fi.Paths) > 0 {
+				name = fi.Paths[0]
+			}
+			names = append(names, name)
+			dhashes = append(dhashes, fi.DHash)
+			hasdhash = append(hasdhash, fi.HasDHash)
+			if len(fi.Paths) > 1 {
+				groups = append(groups, DupGroup{hash: fi.Hash, paths: fi.Paths})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		loggo.Error("stats_lib fail %s %s", database, err)
+		return err
+	}
+
+	loggo.Info("stats_lib lib %s root %s files %d contents %d", libname, root, files, contents)
+	for pixelsize, num := range tiles {
+		loggo.Info("stats_lib pixelsize %s tiles %d", pixelsize, num)
+	}
+
+	// the copies beyond the first are the space a dedup on disk would save
+	dupfiles := 0
+	var dupsize int64
+	for i := range groups {
+		g := &groups[i]
+		osfi, err := os.Stat(resolve_path(root, g.paths[0]))
+		if err == nil {
+			g.size = osfi.Size()
+		}
+		dupfiles += len(g.paths) - 1
+		dupsize += g.size * int64(len(g.paths)-1)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if len(groups[i].paths) != len(groups[j].paths) {
+			return len(groups[i].paths) > len(groups[j].paths)
+		}
+		return groups[i].hash < groups[j].hash
+	})
+
+	for _, g := range groups {
+		loggo.Info("stats_lib duplicate %s copies %d size %d", g.hash, len(g.paths), g.size)
+		for _, p := range g.paths {
+			loggo.Info("stats_lib     %s", p)
+		}
+	}
+	loggo.Info("stats_lib duplicate groups %d files %d size %sM", len(groups), dupfiles, strconv.FormatFloat(float64(dupsize)/1024/1024, 'f', 2, 64))
+
+	nodhash := 0
+	for _, has := range hasdhash {
+		if !has {
+			nodhash++
+		}
+	}
+	if nodhash > 0 {
+		loggo.Info("stats_lib no dhash %d, load the lib again to calc them", nodhash)
+	}
+
+	clusters := make(map[int][]int)
+	for i, c := range near_clusters(dhashes, hasdhash, neardist) {
+		clusters[c] = append(clusters[c], i)
+	}
+	var near [][]int
+	nearnum := 0
+	for _, members := range clusters {
+		if len(members) > 1 {
+			near = append(near, members)
+			nearnum += len(members)
+		}
+	}
+	sort.Slice(near, func(i, j int) bool {
+		if len(near[i]) != len(near[j]) {
+			return len(near[i]) > len(near[j])
+		}
+		return names[near[i][0]] < names[near[j][0]]
+	})
+
+	for _, members := range near {
+		loggo.Info("stats_lib near duplicate contents %d", len(members))
+		for _, i := range members {
+			loggo.Info("stats_lib     %016x %s", dhashes[i], names[i])
+		}
+	}
+	loggo.Info("stats_lib near duplicate clusters %d contents %d dist %d", len(near), nearnum, neardist)
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"github.com/esrrhs/gohome/loggo"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// TileStyle draws tiles like a physical mosaic: smaller than the cell with a
+// grout gap around, of a solid color or the color of the source cell, with
+// rounded corners and a drop shadow on the grout. All of it stays inside the
+// cell, workers draw the cells around at the same time.
+type TileStyle struct {
+	cellsize   int
+	inner      int
+	off        int
+	groutsrc   bool
+	groutcolor color.RGBA
+	shadow     int
+	mask       *image.Alpha
+	shadowmask *image.Alpha
+}
+
+func parse_color(str string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(str), "#")
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || err != nil {
+		return color.RGBA{}, errors.New("color error " + str)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}, nil
+}
+
+// rounded_mask is the coverage of a size*size square with corners of radius r,
+// the edge antialiased.
+func rounded_mask(size int, r int, alpha uint8) *image.Alpha {
+	mask := image.NewAlpha(image.Rect(0, 0, size, size))
+	rf := float64(r)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			// distance into the corner circle, the pixel center counts
+			cx := math.Max(0, math.Max(rf-float64(x)-0.5, float64(x)+0.5-float64(size)+rf))
+			cy := math.Max(0, math.Max(rf-float64(y)-0.5, float64(y)+0.5-float64(size)+rf))
+			cover := 1.0
+			if r > 0 && cx > 0 && cy > 0 {
+				cover = math.Max(0, math.Min(1, rf-math.Sqrt(cx*cx+cy*cy)+0.5))
+			}
+			mask.Pix[mask.PixOffset(x, y)] = uint8(cover * float64(alpha))
+		}
+	}
+	return mask
+}
+
+func new_tile_style(cellsize int, grout int, groutcolor string, corner int, shadow int) (*TileStyle, error) {
+	if grout <= 0 && corner <= 0 && shadow <= 0 {
+		return nil, nil
+	}
+
+	st := &TileStyle{cellsize: cellsize, shadow: shadow}
+	if groutcolor == "src" {
+		st.groutsrc = true
+	} else {
+		c, err := parse_color(groutcolor)
+		if err != nil {
+			loggo.Error("new_tile_style groutcolor fail %s, use #rrggbb or src", groutcolor)
+			return nil, err
+		}
+		st.groutcolor = c
+	}
+
+	st.off = grout / 2
+	st.inner = cellsize - grout - shadow
+	if grout < 0 || corner < 0 || shadow < 0 || st.inner < cellsize/2 {
+		loggo.Error("new_tile_style grout %d shadow %d too big for cell %d", grout, shadow, cellsize)
+		return nil, errors.New("tile style error")
+	}
+	if corner > st.inner/2 {
+		corner = st.inner / 2
+	}
+
+	st.mask = rounded_mask(st.inner, corner, 255)
+	if shadow > 0 {
+		st.shadowmask = rounded_mask(st.inner, corner, 96)
+	}
+
+	loggo.Info("new_tile_style cell %d tile %d grout %d %s corner %d shadow %d", cellsize, st.inner, grout, groutcolor, corner, shadow)
+	return st, nil
+}
+
+// fit scales a tile to the size drawn inside the grout.
+func (st *TileStyle) fit(img *image.RGBA, scaler draw.Scaler) *image.RGBA {
+	if st == nil || img.Bounds().Dx() == st.inner {
+		return img
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, st.inner, st.inner))
+	scaler.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// draw fills the cell at pos with the grout, the shadow and then the tile.
+func (st *TileStyle) draw(img *image.RGBA, pos image.Point, dst *image.RGBA, src color.RGBA) {
+	cell := image.Rect(pos.X, pos.Y, pos.X+st.cellsize, pos.Y+st.cellsize)
+	grout := st.groutcolor
+	if st.groutsrc {
+		grout = color.RGBA{src.R, src.G, src.B, 255}
+	}
+	draw.Draw(dst, cell, &image.Uniform{grout}, image.Point{}, draw.Src)
+
+	at := pos.Add(image.Point{st.off, st.off})
+	if st.shadowmask != nil {
+		r := image.Rectangle{at, at.Add(image.Point{st.inner, st.inner})}.Add(image.Point{st.shadow, st.shadow}).Intersect(cell)
+		draw.DrawMask(dst, r, &image.Uniform{color.Black}, image.Point{}, st.shadowmask, image.Point{}, draw.Over)
+	}
+	draw.DrawMask(dst, image.Rectangle{at, at.Add(image.Point{st.inner, st.inner})}, img, image.Point{}, st.mask, image.Point{}, draw.Over)
+}
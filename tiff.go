@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	tiff_type_short    = 3
+	tiff_type_long     = 4
+	tiff_type_rational = 5
+	tiff_type_long8    = 16
+
+	tiff_tile_size = 256
+
+	// keep some room for the ifd when deciding classic tiff is still enough
+	tiff_classic_limit = 0xFFFFFFFF - 64*1024*1024
+)
+
+type tiff_entry struct {
+	tag   uint16
+	typ   uint16
+	count uint64
+	value []byte
+}
+
+type tiff_writer struct {
+	w      *bufio.Writer
+	off    uint64
+	big    bool
+	tiles  []uint64
+	counts []uint64
+}
+
+func (tw *tiff_writer) write(b []byte) error {
+	n, err := tw.w.Write(b)
+	tw.off += uint64(n)
+	return err
+}
+
+func (tw *tiff_writer) align() error {
+	if tw.off%2 != 0 {
+		return tw.write([]byte{0})
+	}
+	return nil
+}
+
+func tiff_shorts(v ...uint16) []byte {
+	b := make([]byte, 0, len(v)*2)
+	for _, s := range v {
+		b = binary.LittleEndian.AppendUint16(b, s)
+	}
+	return b
+}
+
+func tiff_longs(v ...uint32) []byte {
+	b := make([]byte, 0, len(v)*4)
+	for _, s := range v {
+		b = binary.LittleEndian.AppendUint32(b, s)
+	}
+	return b
+}
+
+func (tw *tiff_writer) offsets(v []uint64) (uint16, []byte) {
+	if !tw.big {
+		b := make([]byte, 0, len(v)*4)
+		for _, s := range v {
+			b = binary.LittleEndian.AppendUint32(b, uint32(s))
+		}
+		return tiff_type_long, b
+	}
+	b := make([]byte, 0, len(v)*8)
+	for _, s := range v {
+		b = binary.LittleEndian.AppendUint64(b, s)
+	}
+	return tiff_type_long8, b
+}
+
+// encode_tiff_tile copies one tile out of img, applies the horizontal predictor
+// and deflates it when compress is set. Edge tiles are padded to full size.
+func encode_tiff_tile(img *image.RGBA, rect image.Rectangle, samples int, compress bool) ([]byte, error) {
+	row := tiff_tile_size * samples
+	data := make([]byte, row*tiff_tile_size)
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		line := data[(y-rect.Min.Y)*row:]
+		pix := img.Pix[img.PixOffset(rect.Min.X, y):]
+		for x := 0; x < rect.Dx(); x++ {
+			copy(line[x*samples:x*samples+samples], pix[x*4:x*4+samples])
+		}
+	}
+
+	if !compress {
+		return data, nil
+	}
+
+	for y := 0; y < tiff_tile_size; y++ {
+		line := data[y*row : (y+1)*row]
+		for i := row - 1; i >= samples; i-- {
+			line[i] -= line[i-samples]
+		}
+	}
+
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	_, err := zw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func write_tiff(f *os.File, img *image.RGBA, dpi int, compress bool, bigtiff bool, workernum int) error {
+	bounds := img.Bounds()
+	samples := 3
+	if !img.Opaque() {
+		// premultiplied like image.RGBA, ExtraSamples 1
+		samples = 4
+	}
+
+	tilesx := (bounds.Dx() + tiff_tile_size - 1) / tiff_tile_size
+	tilesy := (bounds.Dy() + tiff_tile_size - 1) / tiff_tile_size
+
+	rawsize := uint64(tilesx*tilesy) * tiff_tile_size * tiff_tile_size * uint64(samples)
+	// deflate output can be slightly larger than the input
+	if rawsize+rawsize/64 > tiff_classic_limit {
+		bigtiff = true
+	}
+
+	tw := &tiff_writer{w: bufio.NewWriterSize(f, 1024*1024), big: bigtiff}
+
+	var err error
+	if tw.big {
+		err = tw.write([]byte{'I', 'I', 43, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	} else {
+		err = tw.write([]byte{'I', 'I', 42, 0, 0, 0, 0, 0})
+	}
+	if err != nil {
+		return err
+	}
+
+	if workernum <= 0 {
+		workernum = 1
+	}
+
+	// compress one row of tiles in parallel, then write it out in order
+	for ty := 0; ty < tilesy; ty++ {
+		encoded := make([][]byte, tilesx)
+		errs := make([]error, tilesx)
+
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, workernum)
+		for tx := 0; tx < tilesx; tx++ {
+			rect := image.Rect(tx*tiff_tile_size, ty*tiff_tile_size, (tx+1)*tiff_tile_size, (ty+1)*tiff_tile_size).
+				Add(bounds.Min).Intersect(bounds)
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(tx int, rect image.Rectangle) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				encoded[tx], errs[tx] = encode_tiff_tile(img, rect, samples, compress)
+			}(tx, rect)
+		}
+		wg.Wait()
+
+		for tx := 0; tx < tilesx; tx++ {
+			if errs[tx] != nil {
+				return errs[tx]
+			}
+			if !tw.big && tw.off+uint64(len(encoded[tx])) > tiff_classic_limit {
+				return errors.New("tiff too big, use bigtiff")
+			}
+			tw.tiles = append(tw.tiles, tw.off)
+			tw.counts = append(tw.counts, uint64(len(encoded[tx])))
+			err = tw.write(encoded[tx])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	compression := uint16(1)
+	if compress {
+		compression = 8
+	}
+
+	entries := []tiff_entry{
+		{256, tiff_type_long, 1, tiff_longs(uint32(bounds.Dx()))},
+		{257, tiff_type_long, 1, tiff_longs(uint32(bounds.Dy()))},
+		{258, tiff_type_short, uint64(samples), tiff_shorts(8, 8, 8, 8)[:samples*2]},
+		{259, tiff_type_short, 1, tiff_shorts(compression)},
+		{262, tiff_type_short, 1, tiff_shorts(2)},
+		{277, tiff_type_short, 1, tiff_shorts(uint16(samples))},
+		{284, tiff_type_short, 1, tiff_shorts(1)},
+		{322, tiff_type_long, 1, tiff_longs(tiff_tile_size)},
+		{323, tiff_type_long, 1, tiff_longs(tiff_tile_size)},
+	}
+	if compress {
+		entries = append(entries, tiff_entry{317, tiff_type_short, 1, tiff_shorts(2)})
+	}
+	if samples == 4 {
+		entries = append(entries, tiff_entry{338, tiff_type_short, 1, tiff_shorts(1)})
+	}
+	if dpi > 0 {
+		entries = append(entries,
+			tiff_entry{282, tiff_type_rational, 1, tiff_longs(uint32(dpi), 1)},
+			tiff_entry{283, tiff_type_rational, 1, tiff_longs(uint32(dpi), 1)},
+			tiff_entry{296, tiff_type_short, 1, tiff_shorts(2)})
+	}
+	typ, tiles := tw.offsets(tw.tiles)
+	entries = append(entries, tiff_entry{324, typ, uint64(len(tw.tiles)), tiles})
+	typ, counts := tw.offsets(tw.counts)
+	entries = append(entries, tiff_entry{325, typ, uint64(len(tw.counts)), counts})
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].tag < entries[j].tag
+	})
+
+	ifd, err := tw.write_ifd(entries)
+	if err != nil {
+		return err
+	}
+
+	err = tw.w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if tw.big {
+		_, err = f.WriteAt(binary.LittleEndian.AppendUint64(nil, ifd), 8)
+	} else {
+		_, err = f.WriteAt(tiff_longs(uint32(ifd)), 4)
+	}
+	return err
+}
+
+// write_ifd writes the values that do not fit into an entry first, then the
+// ifd itself, and returns the ifd offset.
+func (tw *tiff_writer) write_ifd(entries []tiff_entry) (uint64, error) {
+	inline := 4
+	if tw.big {
+		inline = 8
+	}
+
+	valueoff := make([]uint64, len(entries))
+	for i, e := range entries {
+		if len(e.value) <= inline {
+			continue
+		}
+		err := tw.align()
+		if err != nil {
+			return 0, err
+		}
+		valueoff[i] = tw.off
+		err = tw.write(e.value)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err := tw.align()
+	if err != nil {
+		return 0, err
+	}
+	ifd := tw.off
+
+	var b []byte
+	if tw.big {
+		b = binary.LittleEndian.AppendUint64(b, uint64(len(entries)))
+	} else {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(entries)))
+	}
+	for i, e := range entries {
+		b = binary.LittleEndian.AppendUint16(b, e.tag)
+		b = binary.LittleEndian.AppendUint16(b, e.typ)
+		value := make([]byte, inline)
+		if len(e.value) <= inline {
+			copy(value, e.value)
+		} else if tw.big {
+			binary.LittleEndian.PutUint64(value, valueoff[i])
+		} else {
+			binary.LittleEndian.PutUint32(value, uint32(valueoff[i]))
+		}
+		if tw.big {
+			b = binary.LittleEndian.AppendUint64(b, e.count)
+		} else {
+			b = binary.LittleEndian.AppendUint32(b, uint32(e.count))
+		}
+		b = append(b, value...)
+	}
+	// no next ifd
+	b = append(b, make([]byte, inline)...)
+
+	return ifd, tw.write(b)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/esrrhs/gohome/loggo"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// Tone renders a monochrome mosaic: source and tiles are matched on luminance
+// only and drawn as gray, sepia or a duotone from dark to light.
+type Tone struct {
+	mode  string
+	dark  color.RGBA
+	light color.RGBA
+	// the tone of every luminance
+	table [256]color.RGBA
+}
+
+func new_tone(mode string, duotone string) (*Tone, error) {
+	if mode == "" {
+		return nil, nil
+	}
+	t := &Tone{mode: mode}
+	if mode == "duotone" {
+		cs := strings.Split(duotone, ",")
+		if len(cs) != 2 {
+			loggo.Error("new_tone duotone fail %s, use #rrggbb,#rrggbb", duotone)
+			return nil, errors.New("duotone error")
+		}
+		var err error
+		t.dark, err = parse_color(cs[0])
+		if err == nil {
+			t.light, err = parse_color(cs[1])
+		}
+		if err != nil {
+			loggo.Error("new_tone duotone fail %s %s", duotone, err)
+			return nil, err
+		}
+	} else if mode != "gray" && mode != "sepia" {
+		loggo.Error("new_tone unknown tone %s, use gray/sepia/duotone", mode)
+		return nil, errors.New("unknown tone")
+	}
+	for i := range t.table {
+		t.table[i] = t.color(color.RGBA{uint8(i), uint8(i), uint8(i), 255})
+	}
+	return t, nil
+}
+
+func (t *Tone) String() string {
+	if t == nil {
+		return "off"
+	}
+	if t.mode == "duotone" {
+		return fmt.Sprintf("duotone(#%02x%02x%02x,#%02x%02x%02x)", t.dark.R, t.dark.G, t.dark.B, t.light.R, t.light.G, t.light.B)
+	}
+	return t.mode
+}
+
+func luma8(c color.RGBA) uint8 {
+	return uint8(math.Round(luma(c)))
+}
+
+// gray is what a color is matched as, its luminance on all channels.
+func (t *Tone) gray(c color.RGBA) color.RGBA {
+	if t == nil {
+		return c
+	}
+	y := luma8(c)
+	return color.RGBA{y, y, y, c.A}
+}
+
+// color is what a color is drawn as.
+func (t *Tone) color(c color.RGBA) color.RGBA {
+	if t == nil {
+		return c
+	}
+	y := float64(luma8(c))
+	switch t.mode {
+	case "sepia":
+		return color.RGBA{uint8(math.Min(255, y*1.351)), uint8(math.Min(255, y*1.203)), uint8(y * 0.937), c.A}
+	case "duotone":
+		f := y / 255
+		return color.RGBA{
+			uint8(float64(t.dark.R) + (float64(t.light.R)-float64(t.dark.R))*f),
+			uint8(float64(t.dark.G) + (float64(t.light.G)-float64(t.dark.G))*f),
+			uint8(float64(t.dark.B) + (float64(t.light.B)-float64(t.dark.B))*f),
+			c.A}
+	}
+	return color.RGBA{uint8(y), uint8(y), uint8(y), c.A}
+}
+
+// apply tones the pixels of rect in dst in place, a lookup by luminance as the
+// tone only depends on it.
+func (t *Tone) apply(dst *image.RGBA, rect image.Rectangle) {
+	if t == nil {
+		return
+	}
+	rect = rect.Intersect(dst.Bounds())
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		pix := dst.Pix[dst.PixOffset(rect.Min.X, y):dst.PixOffset(rect.Max.X, y)]
+		for i := 0; i < len(pix); i += 4 {
+			// premultiplied, the luminance without the alpha, the tone with it
+			a := int(pix[i+3])
+			if a == 0 {
+				continue
+			}
+			c := t.table[luma8(color.RGBA{uint8(int(pix[i]) * 255 / a), uint8(int(pix[i+1]) * 255 / a), uint8(int(pix[i+2]) * 255 / a), 0})]
+			pix[i] = uint8(int(c.R) * a / 255)
+			pix[i+1] = uint8(int(c.G) * a / 255)
+			pix[i+2] = uint8(int(c.B) * a / 255)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+const (
+	transform_none = iota
+	transform_hflip
+	transform_vflip
+	transform_rot90
+	transform_rot180
+	transform_rot270
+)
+
+var transform_names = []string{"none", "hflip", "vflip", "rot90", "rot180", "rot270"}
+
+// TransformSet is what may be done to a tile before it is drawn. Without
+// rotations one of them, or none, is picked at random for variety. With
+// rotations the one whose 2x2 sub-tile signature best matches the source cell
+// is drawn instead.
+type TransformSet struct {
+	list []int
+	best bool
+}
+
+func parse_transforms(str string) (*TransformSet, error) {
+	ts := &TransformSet{list: []int{transform_none}}
+	for _, name := range strings.Split(str, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "none" {
+			continue
+		}
+		t := -1
+		for i, n := range transform_names {
+			if n == name {
+				t = i
+			}
+		}
+		if t < 0 {
+			loggo.Error("parse_transforms unknown transform %s, use none/hflip/vflip/rot90/rot180/rot270", name)
+			return nil, errors.New("unknown transform")
+		}
+		if t == transform_rot90 || t == transform_rot180 || t == transform_rot270 {
+			ts.best = true
+		}
+		ts.list = append(ts.list, t)
+	}
+	return ts, nil
+}
+
+// transform_src is the pixel of an n*n image that t moves to x,y.
+func transform_src(t int, x int, y int, n int) (int, int) {
+	switch t {
+	case transform_hflip:
+		return n - 1 - x, y
+	case transform_vflip:
+		return x, n - 1 - y
+	case transform_rot90:
+		return y, n - 1 - x
+	case transform_rot180:
+		return n - 1 - x, n - 1 - y
+	case transform_rot270:
+		return n - 1 - y, x
+	}
+	return x, y
+}
+
+// to_rgba converts a decoded tile once, so drawing it is a plain copy.
+func to_rgba(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+func apply_transform(img *image.RGBA, t int) *image.RGBA {
+	n := img.Bounds().Dx()
+	if t == transform_none || n != img.Bounds().Dy() {
+		return img
+	}
+	dst := image.NewRGBA(img.Bounds())
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			sx, sy := transform_src(t, x, y, n)
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], img.Pix[img.PixOffset(sx, sy):img.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// tile_signature is the average color of the 4 quadrants of the tile, row by row.
+func tile_signature(img *image.RGBA) []color.RGBA {
+	n := img.Bounds().Dx()
+	half := n / 2
+	var sum [4][3]int
+	var num [4]int
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < n; x++ {
+			q := 0
+			if x >= half {
+				q++
+			}
+			if y >= half {
+				q += 2
+			}
+			off := img.PixOffset(x, y)
+			sum[q][0] += int(img.Pix[off])
+			sum[q][1] += int(img.Pix[off+1])
+			sum[q][2] += int(img.Pix[off+2])
+			num[q]++
+		}
+	}
+	sig := make([]color.RGBA, 4)
+	for q := range sig {
+		if num[q] > 0 {
+			sig[q] = color.RGBA{uint8(sum[q][0] / num[q]), uint8(sum[q][1] / num[q]), uint8(sum[q][2] / num[q]), 0}
+		}
+	}
+	return sig
+}
+
+// choose returns the transform for the tile, src is the signature of the cell.
+func (ts *TransformSet) choose(img *image.RGBA, src []color.RGBA) int {
+	if !ts.best || src == nil {
+		return ts.list[common.RandInt31n(len(ts.list))]
+	}
+
+	sig := tile_signature(img)
+	mindiff := math.MaxFloat64
+	var ties []int
+	for _, t := range ts.list {
+		diff := 0.0
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 2; x++ {
+				sx, sy := transform_src(t, x, y, 2)
+				diff += common.ColorDistance(src[y*2+x], sig[sy*2+sx])
+			}
+		}
+		if diff < mindiff {
+			mindiff = diff
+			ties = ties[:0]
+		}
+		if diff == mindiff {
+			ties = append(ties, t)
+		}
+	}
+	return ties[common.RandInt31n(len(ties))]
+}
+
+// cell_signature reads the signature of a cell from the source scaled to 2x2
+// pixels per cell.
+func cell_signature(detail image.Image, x int, y int) []color.RGBA {
+	if detail == nil {
+		return nil
+	}
+	min := detail.Bounds().Min
+	sig := make([]color.RGBA, 4)
+	for q := range sig {
+		sig[q], _ = src_color(detail, min.X+x*2+q%2, min.Y+y*2+q/2)
+	}
+	return sig
+}